@@ -1,9 +1,10 @@
 package wavemq
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"errors"
+	"fmt"
+	"sync"
 )
 
 // AsynchAction describes the signature of the function that will be used to handle asynchronous subscriptions. It
@@ -11,75 +12,423 @@ import (
 // compatable with WaveMQ.
 type AsynchAction func(interface{})
 
+// DefaultQueueLimit is the number of received messages a subscriber holds for the application when the subscriber
+// does not have a limit of its own.
+const DefaultQueueLimit = 1000
+
+// ErrSubscriberClosed is returned when receiving from a subscriber that has been closed.
+var ErrSubscriberClosed = errors.New("Subscriber is closed")
+
+// ErrMessageDropped is reported to the OnError option of a subscriber for every message its drop policy discards.
+var ErrMessageDropped = errors.New("Message dropped because the subscriber queue is full")
+
+// ErrAsynchSubscriber is returned when receiving from an asynchronous subscriber, whose messages are passed to its
+// action instead.
+var ErrAsynchSubscriber = errors.New("Asynchronous subscriber cannot receive messages directly")
+
+// DropPolicy decides what a subscriber does with a message that arrives when its queue is full, because the
+// application does not keep up or because the subscriber is muted.
+//
+// The client acknowledges a QoS 1 or QoS 2 message as soon as it has been handed to the subscribers, so the server does
+// not send it again. A message that DropOldest or DropNewest discards is therefore lost, whatever its quality of
+// service, and only reported to the OnError option of the subscriber. DropNone is the only policy that keeps the
+// guarantee of QoS 1 and QoS 2, at the cost of stalling the client.
+type DropPolicy int
+
+// The following constants define the drop policies of a subscriber.
+const (
+	// DropOldest discards the message that has been held the longest to make room for the new message. It is the
+	// default policy
+	DropOldest DropPolicy = iota
+	// DropNewest discards the new message
+	DropNewest
+	// DropNone keeps every message by pausing the client: it stops reading from the connection until the subscriber
+	// has room for the message, or the connection is closed. While it waits, no other subscriber of the client receives
+	// a message and no acknowledgement is sent, so a single subscriber that does not keep up stalls the whole client
+	DropNone
+)
+
+// SubscriberOptions configures a subscriber when it is created. The options cannot be changed afterwards, since the
+// subscriber may receive messages as soon as it has been created.
+//
+// The messages that arrive are held in the queue of the subscriber until the application takes them, up to QueueLimit
+// messages, which defaults to DefaultQueueLimit. When the queue is full, DropPolicy decides what happens to the next
+// message, which defaults to DropOldest. The client passes the messages to every subscriber without waiting for the
+// application, so a subscriber that does not keep up only holds up the other subscribers and the connection if its
+// policy is DropNone. With the other policies, the messages that are discarded are lost even if they were sent with
+// QoS 1 or QoS 2, and each of them is reported to OnError with ErrMessageDropped.
+//
+// An asynchronous subscriber invokes its action on a pool of Workers goroutines, which defaults to a single worker so
+// that the action is invoked for one message at a time, in the order the messages arrived. With more workers, messages
+// are handled in parallel and may complete in any order. Messages that cannot be decoded, and panics in the action,
+// are reported to OnError, if it is set, and otherwise dropped. OnError is called on the goroutine that received the
+// message or ran the action, so it must not block.
+type SubscriberOptions struct {
+	QueueLimit int
+	DropPolicy DropPolicy
+	Workers    int
+	OnError    func(err error)
+}
+
 // Subscriber defines the member properties of a subscriber in WaveMQ. The subscriber is responsible for retrieving
-// messages from the broker for the topic it has subscribed to and then handing it off to the application.
+// messages from the broker for the topic it has subscribed to and then handing it off to the application, as
+// configured by the options it was created with.
+//
+// A client can have several subscribers on topics with the same name, which share a single subscription on the server
+// and each receive every message. Those subscribers must all have the same message type and must either all be
+// synchronous or all be asynchronous.
+//
+// A muted subscriber stays subscribed and keeps adding the messages that arrive to its queue, but does not pass them on
+// to the application until it is unmuted.
 type Subscriber struct {
-	topic   *Topic
-	decoder *gob.Decoder
-	buf     bytes.Buffer
-	asynch  bool
-	action  AsynchAction
+	topic     *Topic
+	client    *Client
+	asynch    bool
+	action    AsynchAction
+	options   SubscriberOptions
+	start     sync.Once
+	lock      sync.Mutex
+	queue     [][]byte
+	running   int
+	idle      *sync.Cond
+	muted     bool
+	ready     chan struct{}
+	taken     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSubscriber creates a traditional, synchronous subscriber on the provided topic and returns a pointer to it. It
+// does not receive any messages until it belongs to a client, so subscribers are normally created with
+// Client.SubscribeTo instead.
+func NewSubscriber(t *Topic, options SubscriberOptions) *Subscriber {
+	sub := &Subscriber{
+		topic:   t,
+		options: options,
+		ready:   make(chan struct{}, 1),
+		taken:   make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	sub.idle = sync.NewCond(&sub.lock)
+	return sub
+}
+
+// NewAsyncSubscriber creates a new asynchronous subscriber. Whenever a message arrives on the topic, it is decoded
+// into a new value of the type of the message of the topic, which is passed to the action on one of the workers of the
+// subscriber.
+func NewAsyncSubscriber(t *Topic, action AsynchAction, options SubscriberOptions) *Subscriber {
+	sub := NewSubscriber(t, options)
+	sub.asynch, sub.action = true, action
+	return sub
+}
+
+// deliver adds the payload of a received PUBLISH packet to the queue of the subscriber. When the queue is full, the
+// drop policy decides which message is discarded. Only with DropNone does deliver wait for the application to take a
+// message, until the subscriber is closed or the done channel, which is the closed channel of the connection the
+// message arrived on, is closed. Every message the drop policy discards is reported to OnError. A message that arrives
+// once the subscriber is closed is discarded, since nothing takes it from the queue anymore.
+func (sc *Subscriber) deliver(payload []byte, done <-chan struct{}) {
+	sc.lock.Lock()
+	for !sc.isClosed() && len(sc.queue) >= sc.queueLimit() && sc.options.DropPolicy == DropNone {
+		sc.lock.Unlock()
+		select {
+		case <-sc.taken:
+		case <-sc.closed:
+		case <-done:
+			return
+		}
+		sc.lock.Lock()
+	}
+	if sc.isClosed() {
+		sc.lock.Unlock()
+		return
+	}
+	if sc.asynch {
+		sc.start.Do(sc.startWorkers)
+	}
+	dropped := true
+	switch {
+	case len(sc.queue) < sc.queueLimit():
+		sc.queue = append(sc.queue, payload)
+		dropped = false
+	case sc.options.DropPolicy == DropOldest:
+		sc.queue[0] = nil
+		sc.queue = append(sc.queue[1:], payload)
+	}
+	sc.lock.Unlock()
+	signal(sc.ready)
+	if dropped {
+		sc.reportError(ErrMessageDropped)
+	}
+}
+
+// isClosed reports whether the subscriber has been closed. The subscriber must be locked, so that the result holds
+// until it is unlocked.
+func (sc *Subscriber) isClosed() bool {
+	select {
+	case <-sc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueLimit returns the number of messages the queue of the subscriber holds.
+func (sc *Subscriber) queueLimit() int {
+	if sc.options.QueueLimit < 1 {
+		return DefaultQueueLimit
+	}
+	return sc.options.QueueLimit
+}
+
+// take removes the next message from the queue of the subscriber to pass it on to the application. It returns false
+// if the queue is empty or the subscriber is muted. A message taken by a worker of an asynchronous subscriber counts
+// as running until the worker has handled it.
+func (sc *Subscriber) take() ([]byte, bool) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.muted || len(sc.queue) == 0 {
+		return nil, false
+	}
+	payload := sc.queue[0]
+	sc.queue[0] = nil
+	sc.queue = sc.queue[1:]
+	if sc.asynch {
+		sc.running++
+	}
+	if len(sc.queue) > 0 {
+		signal(sc.ready)
+	} else if sc.running == 0 {
+		sc.idle.Broadcast()
+	}
+	signal(sc.taken)
+	return payload, true
+}
+
+// signal wakes up one goroutine that waits on the channel, which has room for a single signal. A signal that nobody
+// waits for is kept until somebody does, so the waiting goroutine must check again what it is waiting for.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
 }
 
-// NewSubscriber creates a traditional, synchronous subscriber on the provided topic and returns a pointer to it.
-func NewSubscriber(t *Topic) *Subscriber {
-	sub := Subscriber{topic: t}
-	_, ok := t.Message.(Encodeable)
-	if !ok {
-		sub.decoder = gob.NewDecoder(&sub.buf)
+// startWorkers starts the workers of an asynchronous subscriber.
+func (sc *Subscriber) startWorkers() {
+	workers := sc.options.Workers
+	if workers < 1 {
+		workers = 1
 	}
-	return &sub
+	for i := 0; i < workers; i++ {
+		go sc.work()
+	}
+}
+
+// work is run by every worker of an asynchronous subscriber. It takes the messages from the queue and dispatches them
+// until the subscriber is closed.
+func (sc *Subscriber) work() {
+	for {
+		payload, ok := sc.take()
+		if !ok {
+			select {
+			case <-sc.ready:
+				continue
+			case <-sc.closed:
+				return
+			}
+		}
+		sc.dispatch(payload)
+		sc.handled()
+	}
+}
+
+// handled records that a worker has handled the message it took from the queue.
+func (sc *Subscriber) handled() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.running--
+	if sc.running == 0 && len(sc.queue) == 0 {
+		sc.idle.Broadcast()
+	}
+}
+
+// dispatch decodes the payload and invokes the action of the subscriber with it. A panic in the action is recovered
+// so that it does not take down the worker.
+func (sc *Subscriber) dispatch(payload []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			sc.reportError(fmt.Errorf("Subscriber action panicked: %v", r))
+		}
+	}()
+	message, err := sc.topic.decodeNew(payload)
+	if err != nil {
+		sc.reportError(err)
+		return
+	}
+	sc.action(message)
 }
 
-// NewAsyncSubscriber creates a new asynchronous subscriber. This type of subscriber will periodically attempt to read
-// from the broker (via a golang channel) and, whenever data is detected, will immediately decode the message and
-// invoke the action registered with the channel.
-func NewAsyncSubscriber(t *Topic, action AsynchAction) {
-	// TODO: ACTUALLY implement reading from the channel
-	sub := Subscriber{topic: t, asynch: true, action: action}
-	if _, ok := t.Message.(Encodeable); !ok {
-		sub.decoder = gob.NewDecoder(&sub.buf)
+// reportError passes an error that occurred while delivering or dispatching a message to the OnError option.
+func (sc *Subscriber) reportError(err error) {
+	if sc.options.OnError != nil {
+		sc.options.OnError(err)
 	}
-	return &sub
 }
 
-// ReceiveIn ...
-func (sc *Subscriber) ReceiveIn(target interface{}) {
+// Wait blocks until an asynchronous subscriber has handled every message it received. Once the client or the
+// subscriber is closed, no more messages arrive, so Wait can be used on shutdown to let the actions that are still
+// running finish. It is safe to call Wait while messages arrive.
+func (sc *Subscriber) Wait() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for len(sc.queue) > 0 || sc.running > 0 {
+		sc.idle.Wait()
+	}
+}
 
+// Mute pauses the delivery of messages to the application without unsubscribing from the topic. The messages that
+// arrive in the meantime are held in the queue of the subscriber, as configured by the QueueLimit and DropPolicy
+// options, until Unmute is called.
+func (sc *Subscriber) Mute() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.muted = true
 }
 
-// Publisher ...
+// Unmute resumes the delivery of messages to the application, starting with the messages that were held while the
+// subscriber was muted.
+func (sc *Subscriber) Unmute() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.muted = false
+	if len(sc.queue) > 0 {
+		signal(sc.ready)
+	}
+}
+
+// Close stops the subscriber, while the client stays connected, and unsubscribes from the topic once no other
+// subscriber of the client shares the subscription. The messages that were held or not received yet are discarded,
+// and the workers of an asynchronous subscriber stop once their current action returns. Receiving from a closed
+// subscriber fails with ErrSubscriberClosed. If the client is not connected, it does not subscribe to the topic again
+// when it connects.
+func (sc *Subscriber) Close() (err error) {
+	sc.closeOnce.Do(func() {
+		if sc.client != nil {
+			err = sc.client.unsubscribe(sc)
+		}
+		sc.lock.Lock()
+		close(sc.closed)
+		sc.queue = nil
+		if sc.running == 0 {
+			sc.idle.Broadcast()
+		}
+		sc.lock.Unlock()
+	})
+	return err
+}
+
+// ReceiveIn blocks until the next message on the topic of the subscriber arrives and decodes it into the target. It
+// is the same as ReceiveInContext with a context that is never done.
+func (sc *Subscriber) ReceiveIn(target interface{}) error {
+	return sc.ReceiveInContext(context.Background(), target)
+}
+
+// ReceiveInContext blocks until the next message on the topic of the subscriber arrives, or the context is done, and
+// decodes the message into the target. If the message of the topic implements Encodeable, the target must implement
+// Decodeable and decodes the message itself. Otherwise the message is decoded with the 'encoding/gob' package, so the
+// target must be a pointer to a value of the type that was published.
+//
+// The messages that were received before the client is closed, or loses its connection without reconnecting, can
+// still be received. After that, ErrNotConnected is returned until the client connects again.
+func (sc *Subscriber) ReceiveInContext(ctx context.Context, target interface{}) error {
+	if sc.client == nil {
+		return ErrNoClient
+	}
+	if sc.asynch {
+		return ErrAsynchSubscriber
+	}
+	if err := sc.topic.checkTarget(target); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-sc.closed:
+			return ErrSubscriberClosed
+		default:
+		}
+		if payload, ok := sc.take(); ok {
+			return sc.topic.decode(payload, target)
+		}
+		select {
+		case <-sc.ready:
+		case <-sc.closed:
+			return ErrSubscriberClosed
+		case <-sc.client.stopped():
+			return ErrNotConnected
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ErrNoClient is returned by a publisher or subscriber that was not created by a client with Client.PublishOn or
+// Client.SubscribeTo, so there is no connection to send or receive messages over.
+var ErrNoClient = errors.New("Publisher or subscriber does not belong to a client")
+
+// Publisher sends messages on a topic over the connection of the client that created it. The properties are used for
+// every PUBLISH packet the publisher sends, except for the topic name, which is always the name of the topic.
 type Publisher struct {
 	Properties PublishProperties
 	topic      *Topic
-	encoder    *gob.Encoder
-	buf        *bytes.Buffer
+	client     *Client
 	asynch     bool
 }
 
-// NewPublisher ...
+// NewPublisher creates a publisher on the provided topic. It cannot send messages until it belongs to a client, so
+// publishers are normally created with Client.PublishOn instead.
 func NewPublisher(t *Topic) *Publisher {
-	ch := Publisher{topic: t}
-	_, ok := t.Message.(Encodeable)
-	if !ok {
-		ch.encoder = gob.NewEncoder(&ch.buf)
-	}
-	return &ch
+	return &Publisher{topic: t}
 }
 
-// Send ...
+// Send encodes the message like every message of the topic and publishes it to the server. Messages of a topic whose
+// message implements Encodeable encode themselves, all other messages are encoded with the 'encoding/gob' package.
+// An error is returned if the message cannot be encoded or the PUBLISH packet cannot be written to the connection.
+//
+// With QoS 1 or QoS 2, the packet identifier is assigned by the client and Send blocks until the delivery completed:
+// until the server answered with a PUBACK for QoS 1 or with a PUBCOMP for QoS 2. An error is returned if the server
+// reports a failure, or ErrDeliveryInterrupted if the client is closed or loses its connection first.
 func (pc *Publisher) Send(message interface{}) error {
-	var payload []byte
-	if pc.encoder != nil {
-		payload = pc.encoder.Encode(&message)
-	} else if _, ok := message.(Encodeable); ok {
-		payload = message.Encode()
-	} else {
-		return errors.New("Unable to encode message because it does not implement 'Encodeable' and no encode is found")
-	}
-	p := packet{}
-	p.initPublish(pc.Properties, payload)
-
-	// TODO: send the packet
-	return nil
+	d, err := pc.publish(message)
+	if err != nil || d == nil {
+		return err
+	}
+	return d.wait()
+}
+
+// SendAsync publishes the message like Send, but returns as soon as the PUBLISH packet has been written to the
+// connection. The token completes with the result Send would have returned, which makes it possible to have many QoS 1
+// and QoS 2 messages in flight at the same time. Only when all 65535 packet identifiers are in use does SendAsync wait
+// for a delivery to complete before it sends the next message.
+func (pc *Publisher) SendAsync(message interface{}) *PublishToken {
+	d, err := pc.publish(message)
+	if d == nil {
+		d = newDelivery(0)
+		d.complete(err)
+	}
+	return &PublishToken{delivery: d}
+}
+
+// publish encodes the message and hands it to the client to send. The delivery is nil for QoS 0.
+func (pc *Publisher) publish(message interface{}) (*delivery, error) {
+	if pc.client == nil {
+		return nil, ErrNoClient
+	}
+	payload, err := pc.topic.encode(message)
+	if err != nil {
+		return nil, err
+	}
+	properties := pc.Properties
+	properties.TopicName = pc.topic.Name
+	return pc.client.publish(properties, payload)
 }
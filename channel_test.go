@@ -0,0 +1,449 @@
+package wavemq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// point is a message that implements Encodeable and Decodeable.
+type point struct {
+	X, Y byte
+}
+
+func (p point) Encode() ([]byte, error) {
+	return []byte{p.X, p.Y}, nil
+}
+
+func (p *point) Decode(b []byte) error {
+	if len(b) != 2 {
+		return errMalformedPoint
+	}
+	p.X, p.Y = b[0], b[1]
+	return nil
+}
+
+var errMalformedPoint = errors.New("Malformed point")
+
+func TestSubscriberReceiveIn(t *testing.T) {
+	server := &testServer{Answer: func(conn *connection, p *packet) {}}
+	address := server.start(t)
+	publishes := server.Publishes
+	defer close(publishes)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	text, _ := client.SubscribeTo(Topic{Name: "text", Message: ""}, SubscriberOptions{})
+	points, _ := client.SubscribeTo(Topic{Name: "points", Message: point{}}, SubscriberOptions{})
+
+	payload, _ := Topic{Name: "text", Message: ""}.encode("hello")
+	publishes <- newPacketPublish(PublishProperties{TopicName: "text"}, payload)
+	publishes <- newPacketPublish(PublishProperties{TopicName: "text"}, []byte{0xFF})
+	publishes <- newPacketPublish(PublishProperties{TopicName: "points"}, []byte{3, 4})
+
+	var message string
+	if err := text.ReceiveIn(&message); err != nil || message != "hello" {
+		t.Errorf("The gob encoded message should have been received, got %q (%v)", message, err)
+	}
+	if err := text.ReceiveIn(&message); err == nil {
+		t.Errorf("A message that cannot be decoded should have returned an error")
+	}
+	var p point
+	if err := points.ReceiveIn(&p); err != nil || p != (point{3, 4}) {
+		t.Errorf("The Encodeable message should have decoded itself, got %v (%v)", p, err)
+	}
+	if err := points.ReceiveIn(p); err == nil {
+		t.Errorf("A target that does not implement Decodeable should have been rejected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := text.ReceiveInContext(ctx, &message); err != context.DeadlineExceeded {
+		t.Errorf("Receiving should have stopped with the context, got %v", err)
+	}
+
+	publishes <- newPacketPublish(PublishProperties{TopicName: "text"}, payload)
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	if err := text.ReceiveIn(&message); err != nil || message != "hello" {
+		t.Errorf("A message received before closing should still be received, got %q (%v)", message, err)
+	}
+	if err := text.ReceiveIn(&message); err != ErrNotConnected {
+		t.Errorf("Receiving from a closed client should have failed with ErrNotConnected, got %v", err)
+	}
+	if err := NewSubscriber(&Topic{Name: "text"}, SubscriberOptions{}).ReceiveIn(&message); err != ErrNoClient {
+		t.Errorf("A subscriber without a client should have failed with ErrNoClient, got %v", err)
+	}
+}
+
+func TestAsyncSubscriberOrdered(t *testing.T) {
+	topic := Topic{Name: "numbers", Message: 0}
+	var received []int
+	sub := NewAsyncSubscriber(&topic, func(message interface{}) {
+		received = append(received, message.(int))
+	}, SubscriberOptions{})
+	for i := 0; i < 100; i++ {
+		payload, _ := topic.encode(i)
+		sub.deliver(payload, nil)
+	}
+	sub.Wait()
+	for i, n := range received {
+		if n != i {
+			t.Fatalf("A single worker should handle the messages in order, got %v", received)
+		}
+	}
+	if len(received) != 100 {
+		t.Errorf("Every message should have been handled, got %v", len(received))
+	}
+}
+
+func TestAsyncSubscriberParallel(t *testing.T) {
+	topic := Topic{Name: "points", Message: point{}}
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	release, once := make(chan struct{}), sync.Once{}
+	sub := NewAsyncSubscriber(&topic, func(message interface{}) {
+		lock.Lock()
+		if running++; running > maxRunning {
+			maxRunning = running
+		}
+		if running == 4 {
+			once.Do(func() { close(release) })
+		}
+		lock.Unlock()
+		<-release
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}, SubscriberOptions{Workers: 4})
+	for i := 0; i < 8; i++ {
+		sub.deliver([]byte{byte(i), 0}, nil)
+	}
+	sub.Wait()
+	if maxRunning != 4 {
+		t.Errorf("All 4 workers should have handled messages at the same time, got %v", maxRunning)
+	}
+}
+
+func TestAsyncSubscriberErrors(t *testing.T) {
+	topic := Topic{Name: "points", Message: point{}}
+	var handled []point
+	var errs []error
+	sub := NewAsyncSubscriber(&topic, func(message interface{}) {
+		p := message.(point)
+		if p.X == 0 {
+			panic("zero")
+		}
+		handled = append(handled, p)
+	}, SubscriberOptions{OnError: func(err error) {
+		errs = append(errs, err)
+	}})
+	sub.deliver([]byte{0, 0}, nil)
+	sub.deliver([]byte{1}, nil)
+	sub.deliver([]byte{2, 3}, nil)
+	sub.Wait()
+	if len(errs) != 2 {
+		t.Errorf("The panic and the malformed message should have been reported, got %v", errs)
+	}
+	if len(handled) != 1 || handled[0] != (point{2, 3}) {
+		t.Errorf("The worker should have survived the panic and handled the next message, got %v", handled)
+	}
+}
+
+func TestAsyncSubscriberWait(t *testing.T) {
+	topic := Topic{Name: "numbers", Message: 0}
+	var lock sync.Mutex
+	handled := 0
+	sub := NewAsyncSubscriber(&topic, func(message interface{}) {
+		lock.Lock()
+		handled++
+		lock.Unlock()
+	}, SubscriberOptions{Workers: 2})
+	payload, _ := topic.encode(1)
+	delivered := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			sub.deliver(payload, nil)
+		}
+		close(delivered)
+	}()
+	// Waiting while messages arrive must be safe
+	for waiting := true; waiting; {
+		select {
+		case <-delivered:
+			waiting = false
+		default:
+			sub.Wait()
+		}
+	}
+	sub.Wait()
+	if handled != 1000 {
+		t.Errorf("Every message should have been handled once Wait returned, got %v", handled)
+	}
+}
+
+// nextMessage returns the next message the subscriber passes on to the application.
+func nextMessage(t *testing.T, sub *Subscriber) string {
+	timeout := time.After(3 * time.Second)
+	for {
+		if payload, ok := sub.take(); ok {
+			return string(payload)
+		}
+		select {
+		case <-sub.ready:
+		case <-timeout:
+			t.Fatalf("The subscriber should have passed on another message")
+			return ""
+		}
+	}
+}
+
+func TestSubscriberMute(t *testing.T) {
+	tests := []struct {
+		policy   DropPolicy
+		expected string
+		dropped  int
+	}{
+		{DropOldest, "bcd", 1},
+		{DropNewest, "abd", 1},
+		{DropNone, "abcd", 0},
+	}
+	for _, test := range tests {
+		var lock sync.Mutex
+		dropped := 0
+		options := SubscriberOptions{QueueLimit: 2, DropPolicy: test.policy, OnError: func(err error) {
+			if err == ErrMessageDropped {
+				lock.Lock()
+				dropped++
+				lock.Unlock()
+			}
+		}}
+		sub := NewSubscriber(&Topic{Name: "letters"}, options)
+		sub.Mute()
+		delivered := make(chan bool)
+		go func() {
+			for _, m := range []string{"a", "b", "c"} {
+				sub.deliver([]byte(m), nil)
+			}
+			delivered <- true
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if _, ok := sub.take(); ok {
+			t.Errorf("A muted subscriber should not pass on messages")
+		}
+		sub.Unmute()
+		messages := nextMessage(t, sub)
+		<-delivered
+		messages += nextMessage(t, sub)
+		sub.deliver([]byte("d"), nil)
+		for len(messages) < len(test.expected) {
+			messages += nextMessage(t, sub)
+		}
+		if messages != test.expected {
+			t.Errorf("Drop policy %v should have passed on %q, got %q", test.policy, test.expected, messages)
+		}
+		lock.Lock()
+		if dropped != test.dropped {
+			t.Errorf("Drop policy %v should have reported %v dropped messages, got %v", test.policy, test.dropped,
+				dropped)
+		}
+		lock.Unlock()
+		sub.Close()
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	acks := make(chan *packet, 10)
+	server := &testServer{Answer: func(conn *connection, p *packet) {
+		if p.ptype == ptypePuback {
+			acks <- p
+		}
+	}}
+	address := server.start(t)
+	defer close(server.Publishes)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	options := SubscriberOptions{QueueLimit: 1, DropPolicy: DropOldest}
+	slow, _ := client.SubscribeTo(Topic{Name: "a/b", Message: ""}, options)
+	client.SubscribeTo(Topic{Name: "a/c", Message: ""}, SubscriberOptions{QueueLimit: 1, DropPolicy: DropNone})
+
+	// The slow subscriber never takes a message, but does not hold up the acknowledgements
+	for id := uint16(1); id <= 3; id++ {
+		h := PublishProperties{QoSLevel: QoSAtLeastOnce, TopicName: "a/b", PacketID: id}
+		server.Publishes <- newPacketPublish(h, []byte{byte('0' + id)})
+		select {
+		case <-acks:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("The client should have acknowledged message %v", id)
+		}
+	}
+	if message := nextMessage(t, slow); message != "3" {
+		t.Errorf("The subscriber should have kept the newest message, got %q", message)
+	}
+
+	// A subscriber that waits for room stops waiting when the connection is closed
+	server.Publishes <- newPacketPublish(PublishProperties{TopicName: "a/c"}, []byte("1"))
+	server.Publishes <- newPacketPublish(PublishProperties{TopicName: "a/c"}, []byte("2"))
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Closing the client should not wait for the subscriber")
+	}
+}
+
+func TestSubscriberClose(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	server.next(t)
+	sub, _ := client.SubscribeTo(Topic{Name: "a/b", Message: ""}, SubscriberOptions{})
+	server.next(t)
+
+	if err := sub.Close(); err != nil {
+		t.Fatalf("An error occurred while closing the subscriber: %v", err)
+	}
+	p := server.next(t)
+	if payload, ok := p.content.(UnsubscribePayload); !ok || len(payload.Topics) != 1 || payload.Topics[0] != "a/b" {
+		t.Errorf("Closing the subscriber should have unsubscribed from its topic, got %+v", p.content)
+	}
+	if _, ok := client.subscribers["a/b"]; ok {
+		t.Errorf("The subscriber should have been removed from the client")
+	}
+	if subscriptions := client.Sessions[client.session].state.subscriptions(); len(subscriptions) != 0 {
+		t.Errorf("The topic should have been removed from the session, got %v", subscriptions)
+	}
+	var message string
+	if err := sub.ReceiveIn(&message); err != ErrSubscriberClosed {
+		t.Errorf("Receiving from a closed subscriber should have failed with ErrSubscriberClosed, got %v", err)
+	}
+	if err := sub.Close(); err != nil {
+		t.Errorf("Closing a subscriber twice should do nothing, got %v", err)
+	}
+}
+
+func TestSubscribeFailed(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	server.next(t)
+	used := make([]uint16, 0, 65535)
+	for id := 1; id <= 65535; id++ {
+		used = append(used, uint16(id))
+	}
+	client.lock.Lock()
+	client.packetIDs = newPacketIDs(used...)
+	client.lock.Unlock()
+
+	sub, err := client.SubscribeTo(Topic{Name: "a/b", Message: ""}, SubscriberOptions{})
+	if err != ErrPacketIDsExhausted || sub != nil {
+		t.Errorf("Subscribing without a packet identifier should have failed, got %v and %v", sub, err)
+	}
+	typed, err := SubscribeTypedAsynch(&client, TypedTopic[string]{Name: "a/b"}, func(string) {}, SubscriberOptions{})
+	if err != ErrPacketIDsExhausted || typed != nil {
+		t.Errorf("Subscribing without a packet identifier should have failed, got %v and %v", typed, err)
+	}
+	if subscribers := client.subscribers["a/b"]; len(subscribers) != 0 {
+		t.Errorf("The failed subscribers should not have been added to the client, got %v", subscribers)
+	}
+	if subscriptions := client.Sessions[client.session].state.subscriptions(); len(subscriptions) != 0 {
+		t.Errorf("The topic should not have been added to the session, got %v", subscriptions)
+	}
+}
+
+func TestSubscriberCloseWhileDelivering(t *testing.T) {
+	topic := Topic{Name: "numbers", Message: 0}
+	payload, _ := topic.encode(1)
+	sub := NewAsyncSubscriber(&topic, func(message interface{}) {}, SubscriberOptions{})
+	sub.deliver(payload, nil)
+	sub.Wait()
+	sub.Close()
+	// The read loop may still hand over a message it received before the subscriber was closed
+	time.Sleep(50 * time.Millisecond)
+	sub.deliver(payload, nil)
+	waited := make(chan struct{})
+	go func() {
+		sub.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Wait should return once the subscriber is closed, even if a message arrives afterwards")
+	}
+}
+
+func TestSubscriptionModes(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	server.next(t)
+
+	first, err := client.SubscribeTo(Topic{Name: "a/b", Message: ""}, SubscriberOptions{})
+	if err != nil {
+		t.Fatalf("The client should have subscribed: %v", err)
+	}
+	if p := server.next(t); p.ptype != ptypeSubscribe {
+		t.Errorf("The first subscriber should have subscribed on the server, got packet type %v", p.ptype)
+	}
+	_, err = client.SubscribeToAsynch(Topic{Name: "a/b", Message: ""}, func(interface{}) {}, SubscriberOptions{})
+	if err != ErrSubscriptionConflict {
+		t.Errorf("Subscribing asynchronously to a synchronous topic should have failed, got %v", err)
+	}
+	_, err = client.SubscribeTo(Topic{Name: "a/b", Message: point{}}, SubscriberOptions{})
+	if err != ErrSubscriptionConflict {
+		t.Errorf("Subscribing to the topic with another message type should have failed, got %v", err)
+	}
+	second, err := client.SubscribeTo(Topic{Name: "a/b", Message: ""}, SubscriberOptions{})
+	if err != nil {
+		t.Fatalf("A second synchronous subscriber should have been created: %v", err)
+	}
+	if len(client.subscribers["a/b"]) != 2 {
+		t.Errorf("The client should have 2 subscribers, got %v", len(client.subscribers["a/b"]))
+	}
+	async, err := client.SubscribeToAsynch(Topic{Name: "a/c", Message: point{}}, func(interface{}) {},
+		SubscriberOptions{})
+	if err != nil {
+		t.Fatalf("The client should have subscribed: %v", err)
+	}
+	server.next(t)
+	var message string
+	if err = async.ReceiveIn(&message); err != ErrAsynchSubscriber {
+		t.Errorf("Receiving from an asynchronous subscriber should have failed, got %v", err)
+	}
+	async.Close()
+	server.next(t)
+
+	// Only closing the last subscriber unsubscribes on the server
+	first.Close()
+	second.Close()
+	p := server.next(t)
+	if payload, ok := p.content.(UnsubscribePayload); !ok || len(payload.Topics) != 1 || payload.Topics[0] != "a/b" {
+		t.Errorf("The shared subscription should have been unsubscribed once, got %+v", p.content)
+	}
+	if len(client.subscribers) != 0 {
+		t.Errorf("The subscribers should have been removed from the client, got %v", client.subscribers)
+	}
+}
@@ -1,59 +1,805 @@
 package wavemq
 
 import (
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
+	"time"
 )
 
-// Client ...
+// DefaultConnectTimeout is how long Client.Connect waits for the server to accept the connection and acknowledge the
+// CONNECT packet when the client does not have a timeout of its own.
+const DefaultConnectTimeout = 30 * time.Second
+
+// The following errors are returned by Client.Connect when the server refuses the connection. The return code of a
+// MQTT 3.1.1 CONNACK and the matching reason codes of a MQTT 5.0 CONNACK are reported as the same error.
+var (
+	// ErrUnacceptableProtocolVersion means the server does not support the requested protocol level
+	ErrUnacceptableProtocolVersion = errors.New("Connection refused: unacceptable protocol version")
+	// ErrIdentifierRejected means the client identifier is valid UTF-8 but the server does not allow it
+	ErrIdentifierRejected = errors.New("Connection refused: identifier rejected")
+	// ErrServerUnavailable means the network connection was made but the MQTT service is unavailable
+	ErrServerUnavailable = errors.New("Connection refused: server unavailable")
+	// ErrBadUserNameOrPassword means the data in the user name or password is malformed or wrong
+	ErrBadUserNameOrPassword = errors.New("Connection refused: bad user name or password")
+	// ErrNotAuthorized means the client is not authorized to connect
+	ErrNotAuthorized = errors.New("Connection refused: not authorized")
+)
+
+// ErrAlreadyConnected is returned by Client.Connect when the client already has an open connection.
+var ErrAlreadyConnected = errors.New("Client is already connected")
+
+// ErrNotConnected is returned when a packet has to be sent but the client does not have a connection.
+var ErrNotConnected = errors.New("Client is not connected")
+
+// ErrUnknownSession is returned by Client.Reconnect when the client does not have a session with the provided id.
+var ErrUnknownSession = errors.New("Unknown session")
+
+// ErrSubscriptionConflict is returned when subscribing to a topic synchronously while the client has an asynchronous
+// subscriber on the same topic, or the other way around. It is also returned when subscribing to a topic whose name the
+// client already subscribed to with another message type, since the messages that arrive on the subscription do not
+// say which type they were published with.
+var ErrSubscriptionConflict = errors.New("Topic is already subscribed to in another mode or with another message type")
+
+// ErrNoMessageType is returned when publishing or subscribing on a topic whose message is nil, which is also the case
+// for a TypedTopic of an interface type, since the client cannot tell which type the messages are encoded with.
+var ErrNoMessageType = errors.New("Topic does not have a message type")
+
+// Client is a MQTT client that connects to a server, publishes messages on topics and receives the messages of the
+// topics it subscribed to. The zero value is ready to use and is configured through its fields, which must be set
+// before the client connects:
+//
+// Name is sent as the client identifier. Sessions holds the sessions the client connected with, keyed by the session
+// id that Connect returns. With Persist, every session that is not a clean session is also saved in Store whenever its
+// state changes, so that Reconnect can resume it after the process restarted. If Store is nil, the sessions are saved
+// in files under the user configuration directory. When a session cannot be saved, Connect and Reconnect still
+// connect but return the error. Close removes the session from the store again, unless it still has messages in flight
+// that resuming it would deliver. Saving encodes the whole session, and the file store syncs it to disk, for every
+// QoS 1 and QoS 2 PUBLISH while the client is locked, so persisting sessions limits how fast the client publishes.
+//
+// ConnectTimeout limits how long connecting may take and defaults to DefaultConnectTimeout. Setting TLSConfig makes the
+// client connect with TLS, with the client certificates for mutual TLS provided through its Certificates or
+// GetClientCertificate fields. Credentials returns the user name and password the client authenticates with, see also
+// SetCredentials. A will set with SetWill is sent with every connection the client opens.
+//
+// PingTimeout is how long the client waits for the answer to a PINGREQ before it considers the connection lost, and
+// defaults to the keep alive interval. OnConnectionLost is called with the cause when the connection is lost for any
+// other reason than a call to Close. RetryInterval is how long a QoS 1 or QoS 2 PUBLISH waits for its acknowledgement
+// before it is sent again as a duplicate, which is only done before MQTT 5.0, and defaults to DefaultRetryInterval.
+//
+// With AutoReconnect, a lost connection is re-established with the server and properties of the last call to Connect,
+// waiting between attempts as configured by Backoff. OnReconnecting is called before every attempt and OnReconnect
+// once an attempt succeeds. OnReconnectError is called with the error of every attempt that fails, and with the error
+// of saving the session once an attempt succeeded. Messages published while the client is reconnecting are queued
+// until it has reconnected. The client gives up when the server refuses the connection for a reason that retrying
+// does not fix, such as ErrBadUserNameOrPassword or ErrNotAuthorized, after which it is closed.
 type Client struct {
-	Name        string
-	Persist     bool
-	Sessions    map[string]Session
-	publishers  map[string]*Publisher
-	subscribers map[string]*Subscriber
-	messages    map[string]bool
+	Name             string
+	Persist          bool
+	Sessions         map[string]Session
+	Store            SessionStore
+	ConnectTimeout   time.Duration
+	TLSConfig        *tls.Config
+	PingTimeout      time.Duration
+	OnConnectionLost func(err error)
+	AutoReconnect    bool
+	Backoff          Backoff
+	OnReconnecting   func(attempt int)
+	OnReconnect      func()
+	OnReconnectError func(attempt int, err error)
+	RetryInterval    time.Duration
+	Credentials      CredentialsProvider
+	will             *will
+	conn             *connection
+	lock             sync.Mutex
+	session          string
+	stop             chan struct{}
+	queue            []*packet
+	packetIDs        *packetIDs
+	deliveries       map[uint16]*delivery
+	requests         map[uint16]bool
+	publishers       map[string]*Publisher
+	subscribers      map[string][]*Subscriber
+	messages         map[string]bool
 }
 
-// Connect ... returns the session id, which can be used as the key to restore the session
+// Connect dials the server, sends a CONNECT packet built from the properties and waits for the CONNACK. The server
+// address may leave out the port, in which case DefaultPort is used, or DefaultTLSPort for a TLS connection. The
+// connection is secured with TLS if the client has a TLSConfig or the address has a "mqtts://" scheme. The client name
+// is sent as the client identifier and the protocol level defaults to MQTT 3.1.1. If the server refuses the connection,
+// one of the connection refused errors is returned. Connect returns the session id, which can be used as the key to
+// restore the session. The will and credential flags of the properties are ignored, they are set from the will and the
+// credentials of the client instead.
 func (c *Client) Connect(server string, properties ConnectProperties) (string, error) {
-	return "", nil
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		return "", ErrAlreadyConnected
+	}
+	if properties.ProtocolLevel == 0 {
+		properties.ProtocolLevel = ProtocolLevel311
+	}
+	conn, ack, address, err := c.open(server, properties, c.Name, c.will, c.Credentials)
+	if err != nil {
+		return "", err
+	}
+
+	identifier := c.Name
+	if ack.Properties != nil && ack.Properties.AssignedClientIdentifier != "" {
+		identifier = ack.Properties.AssignedClientIdentifier
+	}
+	id, err := newSessionID()
+	if err != nil {
+		conn.close()
+		return "", err
+	}
+	if c.Sessions == nil {
+		c.Sessions = map[string]Session{}
+	}
+	c.Sessions[id] = Session{
+		Name:                 c.Name,
+		ServerAddress:        address,
+		identifier:           identifier,
+		ConnectionProperties: properties,
+		state:                &sessionState{},
+	}
+	c.session = id
+	c.stop = make(chan struct{})
+	c.packetIDs = newPacketIDs()
+	c.attach(conn, ack)
+	return id, c.saveSession()
 }
 
-// Reconnect ...
+// Reconnect resumes the session with the id that was returned by Connect. It connects to the server of the session
+// with the client identifier of the session and without a clean session, so that the server keeps its subscriptions
+// and the QoS 1 and QoS 2 messages it was delivering. If the server no longer has the session, the client subscribes
+// to the topics of the session again. Either way, the messages that the client had in flight are sent again.
 func (c *Client) Reconnect(sessionID string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		return ErrAlreadyConnected
+	}
+	session, ok := c.Sessions[sessionID]
+	if !ok && c.Persist {
+		store, err := c.sessionStore()
+		if err != nil {
+			return err
+		}
+		if session, err = store.Load(sessionID); err != nil {
+			return err
+		}
+		ok = true
+	}
+	if !ok {
+		return ErrUnknownSession
+	}
+	session.ConnectionProperties.CleanSession = false
+	if session.state == nil {
+		session.state = &sessionState{}
+	}
+	conn, ack, _, err := c.open(session.ServerAddress, session.ConnectionProperties, session.identifier, c.will,
+		c.Credentials)
+	if err != nil {
+		return err
+	}
+	if c.Sessions == nil {
+		c.Sessions = map[string]Session{}
+	}
+	c.Sessions[sessionID] = session
+	c.session = sessionID
+	c.stop = make(chan struct{})
+	c.packetIDs = newPacketIDs(session.state.inFlightIDs()...)
+	c.attach(conn, ack)
+	return c.saveSession()
+}
+
+// sessionStore returns the store the sessions of the client are saved in, creating the default file store the first
+// time it is needed.
+func (c *Client) sessionStore() (SessionStore, error) {
+	if c.Store != nil {
+		return c.Store, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewFileSessionStore(filepath.Join(dir, "wavemq", "sessions"))
+	if err != nil {
+		return nil, err
+	}
+	c.Store = store
+	return store, nil
+}
+
+// saveSession saves the current session in the store if the client persists its sessions. A clean session is not
+// saved, since the server does not keep it either. The client must be locked.
+func (c *Client) saveSession() error {
+	session, ok := c.Sessions[c.session]
+	if !c.Persist || !ok || session.ConnectionProperties.CleanSession {
+		return nil
+	}
+	store, err := c.sessionStore()
+	if err != nil {
+		return err
+	}
+	return store.Save(c.session, session)
+}
+
+// deleteSession removes the current session from the store if the client persists its sessions and the session does
+// not have messages in flight, which is all that resuming it could still deliver. The client must be locked.
+func (c *Client) deleteSession() error {
+	session, ok := c.Sessions[c.session]
+	if !c.Persist || !ok || session.state.pending() {
+		return nil
+	}
+	store, err := c.sessionStore()
+	if err != nil {
+		return err
+	}
+	return store.Delete(c.session)
+}
+
+// open dials the server and performs the CONNECT/CONNACK handshake with the client identifier, the will and the
+// credentials, which may both be nil, returning the new connection, the CONNACK and the address that was dialed. The
+// address has a "mqtts://" scheme if the connection is secured with TLS.
+func (c *Client) open(server string, properties ConnectProperties, identifier string, will *will,
+	credentials CredentialsProvider) (conn *connection, ack ConnectAckProperties, address string, err error) {
+	connect, err := connectPacket(properties, identifier, will, credentials)
+	if err != nil {
+		return nil, ack, "", err
+	}
+	timeout := c.ConnectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+	address, secure := serverAddress(server, c.TLSConfig != nil)
+	netConn, err := dial(address, secure, c.TLSConfig, timeout)
+	if err != nil {
+		return nil, ack, "", err
+	}
+	if secure {
+		address = "mqtts://" + address
+	}
+	conn = newConnection(netConn, byte(properties.ProtocolLevel))
+	if ack, err = c.handshake(conn, connect, properties.ProtocolLevel, timeout); err != nil {
+		conn.close()
+		return nil, ack, "", err
+	}
+	return conn, ack, address, nil
+}
+
+// attach makes the connection the one the client uses for its current session. It starts the keep alive and the read
+// loop and then restores the session: the client forgets the state the server no longer has, subscribes to the topics
+// the server does not know about, sends the in flight packets again and sends the PUBLISH packets that were queued
+// while the client was reconnecting. Send errors are left for the read loop to discover. The client must be locked.
+func (c *Client) attach(conn *connection, ack ConnectAckProperties) {
+	c.conn = conn
+	session := c.Sessions[c.session]
+
+	// The server may override the keep alive the client asked for
+	keepAlive := time.Duration(session.ConnectionProperties.KeepAlive) * time.Second
+	if ack.Properties != nil && ack.Properties.ServerKeepAlive != nil {
+		keepAlive = time.Duration(*ack.Properties.ServerKeepAlive) * time.Second
+	}
+	if keepAlive > 0 {
+		conn.startKeepAlive(newKeepAlive(keepAlive, c.PingTimeout), func() {
+			c.connectionLost(conn, ErrKeepAliveTimeout)
+		})
+	}
+	go c.readLoop(conn)
+
+	// REQ: MQTT-3.1.2-6
+	if session.ConnectionProperties.CleanSession {
+		c.discardInFlight(session.state)
+		session.state.clear()
+	} else if !ack.SessionPresent {
+		session.state.serverLost()
+	}
+	if topics := c.unknownSubscriptions(session.state, ack.SessionPresent); len(topics) > 0 {
+		if c.sendSubscribe(conn, topics) == nil {
+			session.state.subscribed(topics)
+		}
+	}
+	if session.ConnectionProperties.ProtocolLevel < ProtocolLevel5 {
+		interval := c.RetryInterval
+		if interval == 0 {
+			interval = DefaultRetryInterval
+		}
+		go c.retry(conn, interval)
+	}
+	if err := c.resend(conn, time.Time{}); err != nil {
+		return
+	}
+	for len(c.queue) > 0 {
+		if err := c.write(c.queue[0]); err != nil {
+			return
+		}
+		c.queue = c.queue[1:]
+	}
+}
+
+// unknownSubscriptions returns the topics the client has to subscribe to after connecting. If the server kept the
+// session, it only needs the topics of subscribers that were created while the client was not connected. Otherwise it
+// needs every topic of the session as well as those of the subscribers.
+func (c *Client) unknownSubscriptions(state *sessionState, sessionPresent bool) []TopicSubscription {
+	var topics []TopicSubscription
+	known := state.subscriptions()
+	if !sessionPresent {
+		topics, known = known, nil
+	}
+	for filter := range c.subscribers {
+		if indexOfFilter(known, filter) < 0 && indexOfFilter(topics, filter) < 0 {
+			qos, _ := c.subscriptionQoS(filter)
+			topics = append(topics, TopicSubscription{Filter: filter, QoS: qos})
+		}
+	}
+	return topics
+}
+
+// send writes the packet to the server. While the client is reconnecting, PUBLISH packets are queued and sent as soon
+// as the connection has been re-established. Every other packet fails with ErrNotConnected when there is no
+// connection.
+func (c *Client) send(p *packet) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sendLocked(p)
+}
+
+// sendLocked does the same as send for a client that is already locked.
+func (c *Client) sendLocked(p *packet) error {
+	if c.conn == nil {
+		if c.AutoReconnect && c.stop != nil && p.ptype == ptypePublish {
+			c.queue = append(c.queue, p)
+			return nil
+		}
+		return ErrNotConnected
+	}
+	return c.write(p)
+}
+
+// write sends the packet over the current connection. PUBLISH packets with QoS 1 or QoS 2 are recorded as in flight in
+// the session first, so that they are sent again if the session is resumed before they are acknowledged. The client
+// must be locked.
+func (c *Client) write(p *packet) error {
+	if h, ok := p.properties.(PublishProperties); ok && h.QoSLevel != QoSAtMostOnce {
+		session := c.Sessions[c.session]
+		p.level = byte(session.ConnectionProperties.ProtocolLevel)
+		if err := session.state.store(h.PacketID, p); err != nil {
+			return err
+		}
+		if d := c.deliveries[h.PacketID]; d != nil {
+			d.sent = time.Now()
+		}
+		if err := c.saveSession(); err != nil {
+			return err
+		}
+	}
+	return c.conn.send(p)
+}
+
+// closedChannel is a channel that is always closed.
+var closedChannel = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// stopped returns a channel that is closed when the client is closed, or loses its connection without reconnecting.
+// It is nil while the client has never connected, and already closed while the client is no longer connected.
+func (c *Client) stopped() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stop == nil && c.session != "" {
+		return closedChannel
+	}
+	return c.stop
+}
+
+// readLoop reads the packets the server sends over the connection until it is closed or lost. The keep alive takes
+// note of every packet as it is received, which is all a PINGRESP needs. The packets of the QoS flows are handled in
+// the order they arrive. Received messages are added to the queues of the subscribers, so only a subscriber with the
+// DropNone policy that does not keep up holds up the connection.
+func (c *Client) readLoop(conn *connection) {
+	for {
+		p, err := conn.receive()
+		if err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+		switch p.ptype {
+		case ptypePublish:
+			c.receivedPublish(conn, p)
+		case ptypePuback, ptypePubrec, ptypePubcomp:
+			c.acknowledged(conn, p)
+		case ptypePubrel:
+			c.receivedRelease(conn, p)
+		case ptypeSuback, ptypeUnsuback:
+			c.releasePacketID(p)
+		}
+	}
+}
+
+// connectionLost closes the connection and reports the cause to OnConnectionLost, unless the connection has already
+// been closed or replaced. With AutoReconnect, the client then starts reconnecting. It is safe to call from the read
+// loop and the keep alive at the same time, since only the first call for a connection has any effect.
+func (c *Client) connectionLost(conn *connection, err error) {
+	c.lock.Lock()
+	if c.conn != conn {
+		c.lock.Unlock()
+		return
+	}
+	c.conn = nil
+	conn.close()
+	c.releaseRequests()
+	if !c.AutoReconnect {
+		c.interruptDeliveries()
+		close(c.stop)
+		c.stop = nil
+	}
+	onConnectionLost := c.OnConnectionLost
+	stop := c.stop
+	c.lock.Unlock()
+
+	if onConnectionLost != nil {
+		onConnectionLost(err)
+	}
+	if c.AutoReconnect {
+		go c.reconnect(stop)
+	}
+}
+
+// will is the Last Will and Testament of a client: the message the server publishes on its behalf when the connection
+// is lost without a DISCONNECT.
+type will struct {
+	topic   string
+	message []byte
+	qos     QoSLevel
+	retain  bool
+}
+
+// SetWill sets the Last Will and Testament of the client. When the connection to the server is lost without a call to
+// Close, the server publishes the message on the topic with the quality of service and retain flag. The message is
+// encoded like the messages published on the topic. The will is sent with the next connection the client opens,
+// including the connections opened to reconnect.
+//
+// REQ: MQTT-3.1.2-8, MQTT-3.1.2-14
+func (c *Client) SetWill(topic Topic, message interface{}, qos QoSLevel, retain bool) error {
+	if err := checkTopicName(topic.Name); err != nil {
+		return err
+	}
+	if qos != QoSAtMostOnce && qos != QoSAtLeastOnce && qos != QoSExactlyOnce {
+		return errors.New("Invalid will QoS")
+	}
+	payload, err := topic.encode(message)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.will = &will{topic: topic.Name, message: payload, qos: qos, retain: retain}
 	return nil
 }
 
-// Close ...
+// ClearWill removes the Last Will and Testament of the client, so that the next connection is opened without one.
+func (c *Client) ClearWill() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.will = nil
+}
+
+// CredentialsProvider returns the user name and password the client authenticates with. It is called every time the
+// client connects, so that tokens that expire can be replaced before the client reconnects. An empty user name and a
+// nil password connect without credentials. Returning an error aborts the connection attempt.
+type CredentialsProvider func() (userName string, password []byte, err error)
+
+// SetCredentials makes the client authenticate with the user name and password on every connection it opens. This is
+// the same as setting Credentials to a provider that always returns them.
+func (c *Client) SetCredentials(userName string, password []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Credentials = func() (string, []byte, error) {
+		return userName, password, nil
+	}
+}
+
+// connectPacket creates the CONNECT packet with the client identifier, the will and the credentials, which may all be
+// left out. The connect flags are set from the will and the credentials that are actually sent, so that they always
+// agree with the payload.
+//
+// REQ: MQTT-3.1.2-9, MQTT-3.1.2-19, MQTT-3.1.2-21
+func connectPacket(properties ConnectProperties, identifier string, will *will, credentials CredentialsProvider) (
+	*packet, error) {
+	properties.WillFlag, properties.WillQoS, properties.WillRetain = false, QoSAtMostOnce, false
+	properties.UserName, properties.Password = false, false
+	if will != nil {
+		properties.WillFlag = true
+		properties.WillQoS = will.qos
+		properties.WillRetain = will.retain
+	}
+	var userName string
+	var password []byte
+	if credentials != nil {
+		var err error
+		if userName, password, err = credentials(); err != nil {
+			return nil, err
+		}
+		properties.UserName = userName != ""
+		properties.Password = password != nil
+	}
+	payload := properties.NewPayload()
+	payload.Identifier = identifier
+	if will != nil {
+		payload.WillTopic = will.topic
+		payload.WillMessage = will.message
+	}
+	payload.UserName = userName
+	payload.Password = password
+	return newPacketConnect(properties, payload), nil
+}
+
+// handshake sends the CONNECT packet over the new connection and reads the CONNACK the server answers with. The whole
+// exchange has to finish within the timeout.
+func (c *Client) handshake(conn *connection, connect *packet, level int, timeout time.Duration) (
+	ack ConnectAckProperties, err error) {
+	if err = conn.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return ack, err
+	}
+	if err = conn.send(connect); err != nil {
+		return ack, err
+	}
+	p, err := conn.receive()
+	if err != nil {
+		return ack, err
+	}
+	ack, ok := p.properties.(ConnectAckProperties)
+	if !ok || p.ptype != ptypeConnack {
+		return ack, errors.New("Protocol violation: the server did not answer the CONNECT with a CONNACK")
+	}
+	if err = connectAckError(ack.ReturnCode, level); err != nil {
+		return ack, err
+	}
+	return ack, conn.conn.SetDeadline(time.Time{})
+}
+
+// connectAckError returns the error that matches the return code of a CONNACK packet, or nil if the connection was
+// accepted. The return code is interpreted as a reason code for MQTT 5.0.
+//
+// REQ: MQTT-3.2.2-4
+func connectAckError(code int, level int) error {
+	if code == 0 {
+		return nil
+	}
+	if level >= ProtocolLevel5 {
+		switch ReasonCode(code) {
+		case ReasonUnsupportedProtocolVersion:
+			return ErrUnacceptableProtocolVersion
+		case ReasonClientIdentifierNotValid:
+			return ErrIdentifierRejected
+		case ReasonServerUnavailable, ReasonServerBusy:
+			return ErrServerUnavailable
+		case ReasonBadUserNameOrPassword:
+			return ErrBadUserNameOrPassword
+		case ReasonNotAuthorized:
+			return ErrNotAuthorized
+		}
+	} else {
+		switch code {
+		case 1:
+			return ErrUnacceptableProtocolVersion
+		case 2:
+			return ErrIdentifierRejected
+		case 3:
+			return ErrServerUnavailable
+		case 4:
+			return ErrBadUserNameOrPassword
+		case 5:
+			return ErrNotAuthorized
+		}
+	}
+	return fmt.Errorf("Connection refused with return code 0x%02X", code)
+}
+
+// newSessionID creates a random identifier for a session. It is only used locally as the key in Client.Sessions.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Close sends a DISCONNECT packet to the server and closes the connection. It also stops the client from reconnecting
+// and drops the PUBLISH packets that were queued in the meantime. A persisted session without messages in flight is
+// removed from the store. Closing a client that is not connected does nothing.
 func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+		c.queue = nil
+	}
+	c.interruptDeliveries()
+	c.releaseRequests()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.send(newPacketDisconnect(DisconnectProperties{}))
+	if cerr := c.conn.close(); err == nil {
+		err = cerr
+	}
+	c.conn = nil
+	if derr := c.deleteSession(); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// SubscribeTo creates a synchronous subscriber on the topic, configured with the options, and subscribes to it with the
+// quality of service of the topic. If the client is not connected, the subscription is made as soon as it is. The
+// client also subscribes again every time it reconnects. ErrSubscriptionConflict is returned if the client already has
+// an asynchronous subscriber on the same topic, or a subscriber on a topic with the same name and another message type.
+func (c *Client) SubscribeTo(topic Topic, options SubscriberOptions) (*Subscriber, error) {
+	sub := NewSubscriber(&topic, options)
+	if err := c.subscribe(sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// SubscribeToAsynch creates an asynchronous subscriber on the topic that invokes the action for every message that
+// arrives, and subscribes to the topic like SubscribeTo. ErrSubscriptionConflict is returned if the client already has
+// a synchronous subscriber on the same topic, or a subscriber on a topic with the same name and another message type.
+func (c *Client) SubscribeToAsynch(topic Topic, action AsynchAction, options SubscriberOptions) (*Subscriber, error) {
+	sub := NewAsyncSubscriber(&topic, action, options)
+	if err := c.subscribe(sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// subscribe adds the subscriber to the client. All subscribers whose topic has the same name share a single
+// subscription on the server, so a SUBSCRIBE packet is only sent for the first of them, or when the subscriber asks
+// for a higher quality of service than the subscription has. Those subscribers must all have the same message type and
+// must either all be synchronous or all be asynchronous.
+//
+// The subscriber only belongs to the client once subscribe succeeds. If the SUBSCRIBE packet cannot be sent, or the
+// session cannot be saved afterwards, the client and its session are left as they were.
+func (c *Client) subscribe(sub *Subscriber) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	topic := sub.topic
+	if err := c.registerMessage(topic.Message); err != nil {
+		return err
+	}
+	for _, s := range c.subscribers[topic.Name] {
+		if s.asynch != sub.asynch || reflect.TypeOf(s.topic.Message) != reflect.TypeOf(topic.Message) {
+			return ErrSubscriptionConflict
+		}
+	}
+	qos, subscribed := c.subscriptionQoS(topic.Name)
+	if c.conn == nil || (subscribed && qos >= topic.QoS) {
+		c.addSubscriber(sub)
+		return nil
+	}
+	topics := []TopicSubscription{{Filter: topic.Name, QoS: topic.QoS}}
+	if err := c.sendSubscribe(c.conn, topics); err != nil {
+		return err
+	}
+	state := c.Sessions[c.session].state
+	state.subscribed(topics)
+	if err := c.saveSession(); err != nil {
+		if subscribed {
+			state.subscribed([]TopicSubscription{{Filter: topic.Name, QoS: qos}})
+		} else {
+			state.unsubscribed(topic.Name)
+		}
+		return err
+	}
+	c.addSubscriber(sub)
 	return nil
 }
 
-// SubscribeTo ...
-func (c *Client) SubscribeTo(topic Topic) *Subscriber {
-	c.registerMessage(topic.Message)
-	return NewSubscriber(&topic)
+// addSubscriber adds the subscriber to the subscribers of the client, so that it receives the messages on its topic.
+// The client must be locked.
+func (c *Client) addSubscriber(sub *Subscriber) {
+	sub.client = c
+	if c.subscribers == nil {
+		c.subscribers = map[string][]*Subscriber{}
+	}
+	c.subscribers[sub.topic.Name] = append(c.subscribers[sub.topic.Name], sub)
+}
+
+// subscriptionQoS returns the highest quality of service the subscribers of the topic filter ask for, and false if the
+// client has no subscribers of the topic filter. The client must be locked.
+func (c *Client) subscriptionQoS(filter string) (QoSLevel, bool) {
+	subscribers := c.subscribers[filter]
+	qos := QoSAtMostOnce
+	for _, sub := range subscribers {
+		if sub.topic.QoS > qos {
+			qos = sub.topic.QoS
+		}
+	}
+	return qos, len(subscribers) > 0
+}
+
+// unsubscribe removes the subscriber from the client. When it was the last subscriber of its topic filter, the client
+// also unsubscribes from the topic filter if it is connected. The topic filter is removed from the session either way,
+// so that the client does not subscribe to it again when it reconnects.
+func (c *Client) unsubscribe(sub *Subscriber) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	filter := sub.topic.Name
+	subscribers := c.subscribers[filter]
+	i := 0
+	for i < len(subscribers) && subscribers[i] != sub {
+		i++
+	}
+	if i == len(subscribers) {
+		return nil
+	}
+	if len(subscribers) > 1 {
+		c.subscribers[filter] = append(subscribers[:i:i], subscribers[i+1:]...)
+		return nil
+	}
+	delete(c.subscribers, filter)
+	if session, ok := c.Sessions[c.session]; ok {
+		session.state.unsubscribed(filter)
+		if err := c.saveSession(); err != nil {
+			return err
+		}
+	}
+	if c.conn == nil {
+		return nil
+	}
+	payload := UnsubscribePayload{Topics: []string{filter}}
+	return c.sendRequest(c.conn, func(packetID uint16) *packet {
+		return newPacketUnsubscribe(UnsubscribeProperties{PacketID: packetID}, payload)
+	})
 }
 
-// PublishOn ...
-func (c *Client) PublishOn(topic Topic) *Publisher {
-	c.registerMessage(topic.Message)
-	return NewPublisher(&topic)
+// PublishOn creates a publisher that sends messages on the topic over the connection of the client. ErrNoMessageType
+// is returned if the topic does not have a message.
+func (c *Client) PublishOn(topic Topic) (*Publisher, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.registerMessage(topic.Message); err != nil {
+		return nil, err
+	}
+	pub := NewPublisher(&topic)
+	pub.client = c
+	if c.publishers == nil {
+		c.publishers = map[string]*Publisher{}
+	}
+	c.publishers[topic.Name] = pub
+	return pub, nil
 }
 
 // registerMessage will add the provided message type to the list of messages that this client knows how to
-// process. Types can only be registered once. If the type is registered again, then this function will return false.
-// Returns true if the message is successfully registered.
-func (c *Client) registerMessage(message interface{}) bool {
+// process. Types can only be registered once, so registering a type again does nothing. ErrNoMessageType is returned
+// if the message is nil, since it does not have a type.
+func (c *Client) registerMessage(message interface{}) error {
+	if message == nil {
+		return ErrNoMessageType
+	}
 	t := reflect.TypeOf(message).String()
+	if c.messages == nil {
+		c.messages = map[string]bool{}
+	}
 	if !c.messages[t] {
 		c.messages[t] = true
 		_, encodeable := message.(Encodeable)
 		if !encodeable {
 			gob.Register(message)
 		}
-		return true
 	}
-	return false
+	return nil
 }
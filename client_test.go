@@ -0,0 +1,608 @@
+package wavemq
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is the fake MQTT server the tests connect clients to. It accepts Connections connections one after the
+// other, or a single one if Connections is zero, and answers the CONNECT packet of each with the CONNACK returned by
+// Accept, or closes the connection if Accept returns nil. Without Accept, every connection is accepted without a
+// session present. The packets the client sends after
+// the CONNECT are passed to Answer, or recorded in Received together with the CONNECT if there is no Answer. The
+// packets passed to Publishes are sent to the client over the current connection.
+type testServer struct {
+	Connections int
+	Accept      func(n int, conn *connection, connect *packet) *packet
+	Answer      func(conn *connection, p *packet)
+	Received    chan *packet
+	Publishes   chan *packet
+	lock        sync.Mutex
+	conn        *connection
+}
+
+// start starts the server on a local listener and returns its address.
+func (s *testServer) start(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen on a local port: %v", err)
+	}
+	return s.startOn(listener)
+}
+
+// startOn does the same as start on a listener that has already been created.
+func (s *testServer) startOn(listener net.Listener) string {
+	if s.Received == nil {
+		s.Received = make(chan *packet, 10)
+	}
+	if s.Publishes == nil {
+		s.Publishes = make(chan *packet)
+	}
+	connections := s.Connections
+	if connections == 0 {
+		connections = 1
+	}
+	go func() {
+		for p := range s.Publishes {
+			s.lock.Lock()
+			conn := s.conn
+			s.lock.Unlock()
+			if conn != nil {
+				conn.send(p)
+			}
+		}
+	}()
+	go func() {
+		defer listener.Close()
+		for n := 0; n < connections; n++ {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn := newConnection(netConn, ProtocolLevel311)
+			s.serve(n, conn)
+			conn.close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// serve answers the CONNECT packet of the connection with the number and then handles the packets the client sends
+// until the connection is closed.
+func (s *testServer) serve(n int, conn *connection) {
+	connect, err := conn.receive()
+	if err != nil || connect.ptype != ptypeConnect {
+		return
+	}
+	conn.writer.setProtocolLevel(connect.level)
+	if s.Answer == nil {
+		s.Received <- connect
+	}
+	ack := newPacketConnectAck(ConnectAckProperties{})
+	if s.Accept != nil {
+		ack = s.Accept(n, conn, connect)
+	}
+	if ack == nil || conn.send(ack) != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	for {
+		p, err := conn.receive()
+		if err != nil {
+			return
+		}
+		if s.Answer != nil {
+			s.Answer(conn, p)
+		} else {
+			s.Received <- p
+		}
+	}
+}
+
+// next returns the next packet the server recorded.
+func (s *testServer) next(t *testing.T) *packet {
+	select {
+	case p := <-s.Received:
+		return p
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The server should have received another packet")
+		return nil
+	}
+}
+
+// sessionPresent returns an Accept function that accepts every connection with the session present flag set from the
+// connection number.
+func sessionPresent(present func(n int) bool) func(n int, conn *connection, connect *packet) *packet {
+	return func(n int, conn *connection, connect *packet) *packet {
+		return newPacketConnectAck(ConnectAckProperties{SessionPresent: present(n)})
+	}
+}
+
+func TestClientConnect(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	id, err := client.Connect(address, ConnectProperties{CleanSession: true})
+	if err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	if payload := server.next(t).content.(ConnectPayload); payload.Identifier != "client1" {
+		t.Errorf("The client name should be sent as the identifier, got %v", payload.Identifier)
+	}
+	session, ok := client.Sessions[id]
+	if !ok || id == "" {
+		t.Fatalf("The session %q should have been stored in the client", id)
+	}
+	if session.ServerAddress != address || session.identifier != "client1" {
+		t.Errorf("The session was stored incorrectly: %+v", session)
+	}
+	if _, err = client.Connect(address, ConnectProperties{}); err != ErrAlreadyConnected {
+		t.Errorf("Connecting twice should fail with ErrAlreadyConnected, got %v", err)
+	}
+	if err = client.Close(); err != nil {
+		t.Errorf("An error occurred while closing the client: %v", err)
+	}
+}
+
+func TestClientConnectRefused(t *testing.T) {
+	codes := []struct {
+		level    int
+		code     int
+		expected error
+	}{
+		{ProtocolLevel311, 1, ErrUnacceptableProtocolVersion},
+		{ProtocolLevel311, 2, ErrIdentifierRejected},
+		{ProtocolLevel311, 3, ErrServerUnavailable},
+		{ProtocolLevel311, 4, ErrBadUserNameOrPassword},
+		{ProtocolLevel311, 5, ErrNotAuthorized},
+		{ProtocolLevel5, int(ReasonBadUserNameOrPassword), ErrBadUserNameOrPassword},
+		{ProtocolLevel5, int(ReasonServerBusy), ErrServerUnavailable},
+	}
+	for _, c := range codes {
+		code := c.code
+		address := (&testServer{Accept: func(n int, conn *connection, connect *packet) *packet {
+			return newPacketConnectAck(ConnectAckProperties{ReturnCode: code})
+		}}).start(t)
+		client := Client{Name: "client1"}
+		_, err := client.Connect(address, ConnectProperties{ProtocolLevel: c.level, CleanSession: true})
+		if err != c.expected {
+			t.Errorf("Return code %v should have been reported as %v, got %v", c.code, c.expected, err)
+		}
+		if len(client.Sessions) != 0 {
+			t.Errorf("A refused connection should not create a session")
+		}
+	}
+}
+
+func TestClientConnectTimeout(t *testing.T) {
+	done := make(chan struct{})
+	address := (&testServer{Accept: func(n int, conn *connection, connect *packet) *packet {
+		<-done
+		return nil
+	}}).start(t)
+	defer close(done)
+	client := Client{Name: "client1", ConnectTimeout: 50 * time.Millisecond}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err == nil {
+		t.Errorf("Connecting should time out when the server does not answer")
+	}
+}
+
+func TestServerAddress(t *testing.T) {
+	addresses := []struct {
+		server   string
+		tls      bool
+		expected string
+		secure   bool
+	}{
+		{"localhost", false, "localhost:1883", false},
+		{"192.168.1.124:1884", false, "192.168.1.124:1884", false},
+		{"tcp://broker", false, "broker:1883", false},
+		{"mqtt://broker:8000", false, "broker:8000", false},
+		{"[::1]", false, "[::1]:1883", false},
+		{"[2001:db8::1]:18830", false, "[2001:db8::1]:18830", false},
+		{"mqtts://broker", false, "broker:8883", true},
+		{"ssl://broker:8884", false, "broker:8884", true},
+		{"tls://[::1]", false, "[::1]:8883", true},
+		{"broker", true, "broker:8883", true},
+		{"tcp://broker", true, "broker:1883", false},
+	}
+	for _, a := range addresses {
+		address, secure := serverAddress(a.server, a.tls)
+		if address != a.expected || secure != a.secure {
+			t.Errorf("The address of %v should be %v (TLS %v), got %v (TLS %v)", a.server, a.expected, a.secure,
+				address, secure)
+		}
+	}
+}
+
+// testCertificates holds a certificate authority together with a server and a client certificate signed by it.
+type testCertificates struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	client tls.Certificate
+}
+
+// newTestCertificates generates the certificates used by the TLS tests. The server certificate is valid for localhost
+// and 127.0.0.1.
+func newTestCertificates(t *testing.T) testCertificates {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate a key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "WaveMQ Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Unable to create the CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("Unable to parse the CA certificate: %v", err)
+	}
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Unable to generate a key: %v", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Unable to create the %v certificate: %v", name, err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return testCertificates{
+		pool:   pool,
+		server: issue(2, "server", x509.ExtKeyUsageServerAuth),
+		client: issue(3, "client", x509.ExtKeyUsageClientAuth),
+	}
+}
+
+// serveTLS accepts a single mutual TLS connection and accepts the CONNECT packet sent over it.
+func serveTLS(t *testing.T, certs testCertificates) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certs.server},
+		ClientCAs:    certs.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Unable to listen on a local port: %v", err)
+	}
+	return (&testServer{}).startOn(listener)
+}
+
+func TestClientConnectTLS(t *testing.T) {
+	certs := newTestCertificates(t)
+	address := serveTLS(t, certs)
+	client := Client{Name: "client1", TLSConfig: &tls.Config{
+		RootCAs:      certs.pool,
+		Certificates: []tls.Certificate{certs.client},
+	}}
+	id, err := client.Connect(address, ConnectProperties{CleanSession: true})
+	if err != nil {
+		t.Fatalf("The client should have connected with mutual TLS: %v", err)
+	}
+	if _, ok := client.conn.conn.(*tls.Conn); !ok {
+		t.Errorf("The connection should have been secured with TLS")
+	}
+	if session := client.Sessions[id]; session.ServerAddress != "mqtts://"+address {
+		t.Errorf("The session should remember the TLS address, got %v", session.ServerAddress)
+	}
+	client.Close()
+
+	_, port, _ := net.SplitHostPort(serveTLS(t, certs))
+	anonymous := Client{Name: "client1", TLSConfig: &tls.Config{RootCAs: certs.pool}}
+	if _, err = anonymous.Connect("mqtts://localhost:"+port, ConnectProperties{CleanSession: true}); err == nil {
+		t.Errorf("Connecting without a client certificate should fail")
+		anonymous.Close()
+	}
+}
+
+func TestClientConnectTLSServerName(t *testing.T) {
+	certs := newTestCertificates(t)
+	address := serveTLS(t, certs)
+	client := Client{Name: "client1", TLSConfig: &tls.Config{
+		RootCAs:      certs.pool,
+		Certificates: []tls.Certificate{certs.client},
+		ServerName:   "broker.example.com",
+	}}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err == nil {
+		t.Errorf("Connecting should fail when the certificate does not match the server name")
+		client.Close()
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	pinged := make(chan struct{})
+	pings := 0
+	address := (&testServer{Answer: func(conn *connection, p *packet) {
+		// Only answer the first PINGREQ so the client gives up on the connection
+		if p.ptype == ptypePingreq {
+			if pings++; pings == 1 {
+				conn.send(newPacketPingResp())
+				close(pinged)
+			}
+		}
+	}}).start(t)
+	lost := make(chan error, 1)
+	client := Client{Name: "client1", PingTimeout: 100 * time.Millisecond, OnConnectionLost: func(err error) {
+		lost <- err
+	}}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true, KeepAlive: 1}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	select {
+	case <-pinged:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The client should have sent a PINGREQ after the keep alive interval")
+	}
+	select {
+	case err := <-lost:
+		if err != ErrKeepAliveTimeout {
+			t.Errorf("The connection should have been lost to the keep alive, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The connection should have been lost when the PINGRESP did not arrive")
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Closing a lost connection should do nothing, got %v", err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	for _, present := range []bool{true, false} {
+		server := &testServer{Connections: 2, Accept: sessionPresent(func(n int) bool { return n > 0 && present })}
+		address := server.start(t)
+		next := func() *packet { return server.next(t) }
+
+		client := Client{Name: "client1"}
+		id, err := client.Connect(address, ConnectProperties{})
+		if err != nil {
+			t.Fatalf("The client should have connected: %v", err)
+		}
+		next()
+		client.SubscribeTo(Topic{Name: "a/b", Message: []byte{}}, SubscriberOptions{})
+		next()
+		client.send(newPacketPublish(PublishProperties{QoSLevel: QoSAtLeastOnce, TopicName: "a/b", PacketID: 7}, nil))
+		next()
+		client.Close()
+		next()
+
+		if err = client.Reconnect(id); err != nil {
+			t.Fatalf("The client should have resumed the session: %v", err)
+		}
+		p := next()
+		h, payload := p.properties.(ConnectProperties), p.content.(ConnectPayload)
+		if h.CleanSession || payload.Identifier != "client1" {
+			t.Errorf("The session should be resumed with its identifier and without a clean session")
+		}
+		if !present {
+			if p = next(); p.ptype != ptypeSubscribe || p.content.(SubscribePayload).Topics[0].Filter != "a/b" {
+				t.Errorf("The client should subscribe again when the server lost the session")
+			}
+		}
+		p = next()
+		if h, ok := p.properties.(PublishProperties); !ok || !h.DupFlag || h.PacketID != 7 {
+			t.Errorf("The in flight PUBLISH should have been sent again as a duplicate, got %+v", p.properties)
+		}
+		client.Close()
+	}
+
+	client := Client{}
+	if err := client.Reconnect("unknown"); err != ErrUnknownSession {
+		t.Errorf("Resuming an unknown session should fail with ErrUnknownSession, got %v", err)
+	}
+}
+
+func TestClientPersist(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("An error occurred while creating the store: %v", err)
+	}
+	server := &testServer{Connections: 2, Accept: sessionPresent(func(n int) bool { return n > 0 })}
+	address := server.start(t)
+	client := Client{Name: "client1", Persist: true, Store: store}
+	id, err := client.Connect(address, ConnectProperties{})
+	if err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	server.next(t)
+	err = client.send(newPacketPublish(PublishProperties{QoSLevel: QoSAtLeastOnce, TopicName: "a", PacketID: 5}, nil))
+	if err != nil {
+		t.Fatalf("An error occurred while publishing: %v", err)
+	}
+	server.next(t)
+	client.Close()
+	server.next(t)
+
+	// A new client, as if the process restarted, resumes the session from the store
+	restarted := Client{Persist: true, Store: store}
+	if err = restarted.Reconnect(id); err != nil {
+		t.Fatalf("The session should have been loaded from the store: %v", err)
+	}
+	defer restarted.Close()
+	if p := server.next(t); p.content.(ConnectPayload).Identifier != "client1" {
+		t.Errorf("The stored client identifier should have been used")
+	}
+	if h, ok := server.next(t).properties.(PublishProperties); !ok || h.PacketID != 5 || !h.DupFlag {
+		t.Errorf("The stored in flight PUBLISH should have been sent again, got %+v", h)
+	}
+}
+
+func TestClientPersistRemovesSessions(t *testing.T) {
+	store := &MemorySessionStore{}
+	server := &testServer{Connections: 2}
+	address := server.start(t)
+	client := Client{Name: "client1", Persist: true, Store: store}
+	id, err := client.Connect(address, ConnectProperties{CleanSession: true})
+	if err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	server.next(t)
+	if _, err = store.Load(id); err != ErrUnknownSession {
+		t.Errorf("A clean session should not have been saved, got %v", err)
+	}
+	client.Close()
+	server.next(t)
+
+	if id, err = client.Connect(address, ConnectProperties{}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	server.next(t)
+	if _, err = store.Load(id); err != nil {
+		t.Errorf("The session should have been saved: %v", err)
+	}
+	if err = client.Close(); err != nil {
+		t.Fatalf("An error occurred while closing the client: %v", err)
+	}
+	if _, err = store.Load(id); err != ErrUnknownSession {
+		t.Errorf("Closing the client without messages in flight should have removed the session, got %v", err)
+	}
+}
+
+func TestClientWill(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	if err := client.SetWill(Topic{Name: "status/#", Message: ""}, "offline", QoSAtLeastOnce, false); err == nil {
+		t.Errorf("A will topic with a wildcard should have been rejected")
+	}
+	if err := client.SetWill(Topic{Name: "status", Message: ""}, "offline", QoSAtLeastOnce, true); err != nil {
+		t.Fatalf("The will should have been set: %v", err)
+	}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+
+	connect := server.next(t)
+	h := connect.properties.(ConnectProperties)
+	if !h.WillFlag || h.WillQoS != QoSAtLeastOnce || !h.WillRetain {
+		t.Errorf("The will flags were sent incorrectly: %+v", h)
+	}
+	payload := connect.content.(ConnectPayload)
+	var message string
+	if err := gob.NewDecoder(bytes.NewReader(payload.WillMessage.([]byte))).Decode(&message); err != nil {
+		t.Errorf("The will message should have been encoded with gob: %v", err)
+	}
+	if payload.WillTopic != "status" || message != "offline" {
+		t.Errorf("The will was sent incorrectly. Expected status/offline and got %v/%v", payload.WillTopic, message)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	server := &testServer{Connections: 2, Accept: sessionPresent(func(n int) bool { return n > 0 })}
+	address := server.start(t)
+	tokens := 0
+	client := Client{Name: "client1", Credentials: func() (string, []byte, error) {
+		tokens++
+		return "user", []byte(fmt.Sprintf("token%v", tokens)), nil
+	}}
+	id, err := client.Connect(address, ConnectProperties{})
+	if err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	connect := server.next(t)
+	h, payload := connect.properties.(ConnectProperties), connect.content.(ConnectPayload)
+	if !h.UserName || !h.Password || payload.UserName != "user" || string(payload.Password) != "token1" {
+		t.Errorf("The credentials were sent incorrectly: %+v, %+v", h, payload)
+	}
+	client.Close()
+	server.next(t)
+
+	// The provider is asked for fresh credentials when the client connects again
+	if err = client.Reconnect(id); err != nil {
+		t.Fatalf("The client should have reconnected: %v", err)
+	}
+	defer client.Close()
+	if payload = server.next(t).content.(ConnectPayload); string(payload.Password) != "token2" {
+		t.Errorf("The credentials should have been renewed, got %v", string(payload.Password))
+	}
+
+	failing := Client{Name: "client2", Credentials: func() (string, []byte, error) {
+		return "", nil, errors.New("no token")
+	}}
+	if _, err = failing.Connect(address, ConnectProperties{}); err == nil || err.Error() != "no token" {
+		t.Errorf("The error of the credentials provider should have been returned, got %v", err)
+	}
+}
+
+func TestClientSetCredentials(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	client.SetCredentials("user", nil)
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	if payload := server.next(t).content.(ConnectPayload); payload.UserName != "user" || payload.Password != nil {
+		t.Errorf("Only the user name should have been sent, got %+v", payload)
+	}
+}
+
+func TestPublisherSend(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	server.next(t)
+
+	pub, _ := client.PublishOn(Topic{Name: "greeting", Message: ""})
+	pub.Properties = PublishProperties{Retain: true, TopicName: "ignored"}
+	if err := pub.Send("hello"); err != nil {
+		t.Fatalf("An error occurred while publishing: %v", err)
+	}
+	p := server.next(t)
+	h, ok := p.properties.(PublishProperties)
+	if !ok || h.TopicName != "greeting" || !h.Retain || h.QoSLevel != QoSAtMostOnce {
+		t.Errorf("The PUBLISH packet was sent with the wrong properties: %+v", p.properties)
+	}
+	var message string
+	if err := gob.NewDecoder(bytes.NewReader(p.payload)).Decode(&message); err != nil || message != "hello" {
+		t.Errorf("The message was encoded incorrectly. Expected hello and got %q (%v)", message, err)
+	}
+
+	client.Close()
+	if err := pub.Send("hello"); err != ErrNotConnected {
+		t.Errorf("Sending without a connection should have failed with ErrNotConnected, got %v", err)
+	}
+	if err := NewPublisher(&Topic{Name: "greeting"}).Send("hello"); err != ErrNoClient {
+		t.Errorf("A publisher without a client should have failed with ErrNoClient, got %v", err)
+	}
+}
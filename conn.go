@@ -0,0 +1,133 @@
+package wavemq
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The following constants define the ports a MQTT server listens on. They are used when the address passed to
+// Client.Connect does not have a port.
+const (
+	// DefaultPort is the port for unencrypted connections
+	DefaultPort = "1883"
+	// DefaultTLSPort is the port for connections secured with TLS
+	DefaultTLSPort = "8883"
+)
+
+// connection is a single network connection to a MQTT server. Reads are only ever done by one goroutine at a time, but
+// writes are serialized with a lock so that publishers, subscribers and the client can share the connection.
+type connection struct {
+	conn      net.Conn
+	reader    *packetReader
+	writer    *packetWriter
+	wlock     sync.Mutex
+	keepAlive *keepAlive
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newConnection wraps the network connection so that packets can be read and written in the format of the provided
+// protocol level.
+func newConnection(conn net.Conn, level byte) *connection {
+	c := &connection{
+		conn:   conn,
+		reader: newPacketReader(conn, 0),
+		writer: newPacketWriter(conn),
+		closed: make(chan struct{}),
+	}
+	c.reader.setProtocolLevel(level)
+	c.writer.setProtocolLevel(level)
+	return c
+}
+
+// send encodes the packet and writes it to the connection. It is safe to call send from multiple goroutines.
+func (c *connection) send(p *packet) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if err := c.writer.writePacket(p); err != nil {
+		return err
+	}
+	if c.keepAlive != nil {
+		c.keepAlive.sent(time.Now())
+	}
+	return nil
+}
+
+// receive blocks until the next packet has been read from the connection.
+func (c *connection) receive() (*packet, error) {
+	p, err := c.reader.readPacket()
+	if err == nil && c.keepAlive != nil {
+		c.keepAlive.received(p.ptype, time.Now())
+	}
+	return p, err
+}
+
+// startKeepAlive starts tracking the activity on the connection with the keep alive until the connection is closed.
+// On the client side, the keep alive sends PINGREQ packets over the connection. The expire function is called if the
+// keep alive declares the connection dead. It must be called before packets are sent or received concurrently.
+func (c *connection) startKeepAlive(k *keepAlive, expire func()) {
+	c.keepAlive = k
+	var ping func() error
+	if !k.server {
+		ping = func() error {
+			return c.send(newPacketPingReq())
+		}
+	}
+	go k.run(c.closed, ping, expire)
+}
+
+// close closes the underlying network connection, which also unblocks a pending receive and stops the keep alive.
+// Only the first call closes the connection, later calls do nothing.
+func (c *connection) close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// serverAddress turns the server passed to Client.Connect into an address that can be dialed and reports whether the
+// connection has to be secured with TLS. The server may be prefixed with a "tcp://" or "mqtt://" scheme for a plain
+// connection, or with a "mqtts://", "ssl://" or "tls://" scheme for a TLS connection. Without a scheme, TLS is used if
+// secure is true. DefaultPort or DefaultTLSPort is used if the server does not include a port.
+func serverAddress(server string, secure bool) (string, bool) {
+	if i := strings.Index(server, "://"); i >= 0 {
+		switch server[:i] {
+		case "tcp", "mqtt":
+			secure = false
+			server = server[i+3:]
+		case "mqtts", "ssl", "tls":
+			secure = true
+			server = server[i+3:]
+		}
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, secure
+	}
+	port := DefaultPort
+	if secure {
+		port = DefaultTLSPort
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port), secure
+}
+
+// dial opens a network connection to the address, performing the TLS handshake with the provided configuration if
+// the connection is secure. A nil configuration uses the defaults of the crypto/tls package. If the configuration does
+// not name the server, the host of the address is used to verify the certificate of the server.
+func dial(address string, secure bool, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !secure {
+		return dialer.Dial("tcp", address)
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	return tls.DialWithDialer(dialer, "tcp", address, config)
+}
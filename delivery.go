@@ -0,0 +1,367 @@
+package wavemq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultRetryInterval is how long a client waits for the acknowledgement of a QoS 1 or QoS 2 packet before sending it
+// again when the client does not have an interval of its own.
+const DefaultRetryInterval = 20 * time.Second
+
+// ErrDeliveryInterrupted is returned for a QoS 1 or QoS 2 PUBLISH when the client is closed, or loses its connection
+// without reconnecting, before the delivery completed. The message stays in flight in the session, so it is sent again
+// if the session is resumed with Client.Reconnect. It is also returned when the client reconnects with a clean session,
+// which discards the message instead.
+var ErrDeliveryInterrupted = errors.New("Delivery interrupted before it was acknowledged")
+
+// delivery tracks an outbound QoS 1 or QoS 2 PUBLISH from the moment it is sent until its flow completes: with a
+// PUBACK for QoS 1, or with a PUBREC, PUBREL and PUBCOMP exchange for QoS 2. The done channel is closed once the
+// result is known.
+type delivery struct {
+	packetID uint16
+	sent     time.Time
+	done     chan struct{}
+	err      error
+}
+
+// newDelivery creates the delivery of the PUBLISH packet with the identifier.
+func newDelivery(packetID uint16) *delivery {
+	return &delivery{packetID: packetID, done: make(chan struct{})}
+}
+
+// complete records the result of the delivery. It must only be called once, which the client guarantees by removing
+// the delivery from its deliveries first.
+func (d *delivery) complete(err error) {
+	d.err = err
+	close(d.done)
+}
+
+// wait blocks until the delivery has completed and returns its result.
+func (d *delivery) wait() error {
+	<-d.done
+	return d.err
+}
+
+// PublishToken is the result of a message published with Publisher.SendAsync. It completes when the delivery of the
+// message has completed, or failed, in the same way Publisher.Send returns.
+type PublishToken struct {
+	delivery *delivery
+}
+
+// Done returns a channel that is closed once the delivery has completed.
+func (t *PublishToken) Done() <-chan struct{} {
+	return t.delivery.done
+}
+
+// Err returns the result of the delivery once it has completed. Before that, it returns nil.
+func (t *PublishToken) Err() error {
+	select {
+	case <-t.delivery.done:
+		return t.delivery.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the delivery has completed and returns its result, or returns the error of the context if it is
+// done first. A delivery that is still in progress when the context is done carries on.
+func (t *PublishToken) Wait(ctx context.Context) error {
+	select {
+	case <-t.delivery.done:
+		return t.delivery.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publish sends a PUBLISH packet with the properties and payload. For QoS 1 and QoS 2 a packet identifier is assigned
+// and the returned delivery completes once the server acknowledged the packet. For QoS 0 the delivery is nil.
+// When every packet identifier is in use, publish waits for one to be released until the client is closed.
+func (c *Client) publish(properties PublishProperties, payload []byte) (*delivery, error) {
+	if properties.QoSLevel == QoSAtMostOnce {
+		return nil, c.send(newPacketPublish(properties, payload))
+	}
+	c.lock.Lock()
+	ids, stop := c.packetIDs, c.stop
+	c.lock.Unlock()
+	if ids == nil {
+		return nil, ErrNotConnected
+	}
+	packetID, err := ids.acquire(stop)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	properties.PacketID = packetID
+	d := newDelivery(packetID)
+	if c.deliveries == nil {
+		c.deliveries = map[uint16]*delivery{}
+	}
+	c.deliveries[packetID] = d
+	if err = c.sendLocked(newPacketPublish(properties, payload)); err != nil {
+		delete(c.deliveries, packetID)
+		ids.release(packetID)
+		if session, ok := c.Sessions[c.session]; ok {
+			session.state.release(packetID)
+			c.saveSession()
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// acknowledged handles the PUBACK, PUBREC and PUBCOMP packets the server sends for the QoS 1 and QoS 2 PUBLISH packets
+// of the client. A PUBREC is answered with a PUBREL, which replaces the PUBLISH in flight so that only the PUBREL is
+// sent again from then on. A reason code that reports a failure ends the delivery with an error.
+//
+// REQ: MQTT-4.3.2-1, MQTT-4.3.3-1
+func (c *Client) acknowledged(conn *connection, p *packet) {
+	var packetID uint16
+	var reason ReasonCode
+	switch h := p.properties.(type) {
+	case PublishAckProperties:
+		packetID, reason = h.PacketID, h.ReasonCode
+	case PublishRecProperties:
+		packetID, reason = h.PacketID, h.ReasonCode
+	case PublishCompProperties:
+		packetID, reason = h.PacketID, h.ReasonCode
+	default:
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	session, ok := c.Sessions[c.session]
+	if !ok || c.conn != conn {
+		return
+	}
+	if p.ptype == ptypePubrec && !reason.Failed() {
+		rel := newPacketPublishRel(PublishRelProperties{PacketID: packetID})
+		rel.level = byte(session.ConnectionProperties.ProtocolLevel)
+		if session.state.store(packetID, rel) == nil {
+			c.saveSession()
+		}
+		if d := c.deliveries[packetID]; d != nil {
+			d.sent = time.Now()
+		}
+		conn.send(rel)
+		return
+	}
+	session.state.release(packetID)
+	c.saveSession()
+	c.packetIDs.release(packetID)
+	if d := c.deliveries[packetID]; d != nil {
+		delete(c.deliveries, packetID)
+		if reason.Failed() {
+			d.complete(fmt.Errorf("Publish failed with reason code 0x%02X", byte(reason)))
+		} else {
+			d.complete(nil)
+		}
+	}
+}
+
+// sendSubscribe sends a SUBSCRIBE packet for the topics over the connection. The client must be locked.
+func (c *Client) sendSubscribe(conn *connection, topics []TopicSubscription) error {
+	return c.sendRequest(conn, func(packetID uint16) *packet {
+		return newPacketSubscribe(SubscribeProperties{PacketID: packetID}, SubscribePayload{Topics: topics})
+	})
+}
+
+// sendRequest sends the SUBSCRIBE or UNSUBSCRIBE packet that is created with a new packet identifier over the
+// connection. The identifier is released right away if the packet cannot be sent, and otherwise once the packet has
+// been acknowledged or the connection is lost. The client must be locked.
+func (c *Client) sendRequest(conn *connection, create func(packetID uint16) *packet) error {
+	packetID, err := c.packetIDs.allocate()
+	if err != nil {
+		return err
+	}
+	if err = conn.send(create(packetID)); err != nil {
+		c.packetIDs.release(packetID)
+		return err
+	}
+	if c.requests == nil {
+		c.requests = map[uint16]bool{}
+	}
+	c.requests[packetID] = true
+	return nil
+}
+
+// releasePacketID makes the packet identifier of a SUBACK or UNSUBACK available again, now that the SUBSCRIBE or
+// UNSUBSCRIBE it was used for has been acknowledged.
+func (c *Client) releasePacketID(p *packet) {
+	var packetID uint16
+	switch h := p.properties.(type) {
+	case SubscribeAckProperties:
+		packetID = h.PacketID
+	case UnsubscribeAckProperties:
+		packetID = h.PacketID
+	default:
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.requests[packetID] {
+		delete(c.requests, packetID)
+		c.packetIDs.release(packetID)
+	}
+}
+
+// releaseRequests releases the packet identifiers of the SUBSCRIBE and UNSUBSCRIBE packets that are waiting for their
+// acknowledgement. Unlike PUBLISH packets, they are not sent again after reconnecting, so their acknowledgement never
+// arrives once the connection is lost. The client must be locked.
+func (c *Client) releaseRequests() {
+	for packetID := range c.requests {
+		delete(c.requests, packetID)
+		c.packetIDs.release(packetID)
+	}
+}
+
+// interruptDeliveries ends every delivery that is waiting for an acknowledgement with ErrDeliveryInterrupted. The
+// client must be locked.
+func (c *Client) interruptDeliveries() {
+	for id, d := range c.deliveries {
+		delete(c.deliveries, id)
+		d.complete(ErrDeliveryInterrupted)
+	}
+}
+
+// discardInFlight ends the deliveries of the in flight packets of the session with ErrDeliveryInterrupted and releases
+// their packet identifiers. It is used when the client connects with a clean session, which throws the in flight
+// packets away instead of sending them again. The client must be locked.
+func (c *Client) discardInFlight(state *sessionState) {
+	for _, packetID := range state.inFlightIDs() {
+		c.packetIDs.release(packetID)
+		if d := c.deliveries[packetID]; d != nil {
+			delete(c.deliveries, packetID)
+			d.complete(ErrDeliveryInterrupted)
+		}
+	}
+}
+
+// retry sends the in flight packets of the session again, marked as duplicates, when they have not been acknowledged
+// within the retry interval. It runs until the connection is closed. Since MQTT 5.0 forbids sending a packet again
+// other than after reconnecting, it is only used for earlier protocol levels.
+func (c *Client) retry(conn *connection, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case now := <-ticker.C:
+			c.lock.Lock()
+			if c.conn == conn {
+				c.resend(conn, now.Add(-interval))
+			}
+			c.lock.Unlock()
+		}
+	}
+}
+
+// resend sends the in flight packets of the session that were last sent before the provided time again, or all of them
+// if the time is zero. Packets that the client does not have a delivery for, which happens when the session was loaded
+// from a store, are given one so that their acknowledgement is tracked like any other. The client must be locked.
+func (c *Client) resend(conn *connection, before time.Time) error {
+	session := c.Sessions[c.session]
+	packets, err := session.state.replay(byte(session.ConnectionProperties.ProtocolLevel))
+	if err != nil {
+		return err
+	}
+	if c.deliveries == nil {
+		c.deliveries = map[uint16]*delivery{}
+	}
+	now := time.Now()
+	for _, p := range packets {
+		packetID := inFlightPacketID(p)
+		d := c.deliveries[packetID]
+		if d == nil {
+			d = newDelivery(packetID)
+			c.deliveries[packetID] = d
+		} else if !before.IsZero() && !d.sent.Before(before) {
+			continue
+		}
+		d.sent = now
+		if err = conn.send(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inFlightPacketID returns the packet identifier of an in flight PUBLISH or PUBREL packet.
+func inFlightPacketID(p *packet) uint16 {
+	switch h := p.properties.(type) {
+	case PublishProperties:
+		return h.PacketID
+	case PublishRelProperties:
+		return h.PacketID
+	}
+	return 0
+}
+
+// receivedPublish handles a PUBLISH packet the server sends to the client. The message is handed to every subscriber
+// whose topic matches the topic name of the packet, after which a QoS 1 packet is acknowledged with a PUBACK and a
+// QoS 2 packet with a PUBREC. The packet identifier of a QoS 2 packet is kept until the server releases it with a
+// PUBREL, so a QoS 2 message that the server sends again in the meantime is acknowledged without being handed to the
+// subscribers a second time.
+//
+// REQ: MQTT-4.3.2-2, MQTT-4.3.3-2
+func (c *Client) receivedPublish(conn *connection, p *packet) {
+	h, ok := p.properties.(PublishProperties)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	session, ok := c.Sessions[c.session]
+	if !ok || c.conn != conn {
+		c.lock.Unlock()
+		return
+	}
+	first := true
+	if h.QoSLevel == QoSExactlyOnce {
+		first = session.state.received(h.PacketID)
+		c.saveSession()
+	}
+	var subscribers []*Subscriber
+	if first {
+		for filter, subs := range c.subscribers {
+			if matchTopic(filter, h.TopicName) {
+				subscribers = append(subscribers, subs...)
+			}
+		}
+	}
+	c.lock.Unlock()
+
+	for _, sub := range subscribers {
+		sub.deliver(p.payload, conn.closed)
+	}
+	switch h.QoSLevel {
+	case QoSAtLeastOnce:
+		conn.send(newPacketPublishAck(PublishAckProperties{PacketID: h.PacketID}))
+	case QoSExactlyOnce:
+		conn.send(newPacketPublishRec(PublishRecProperties{PacketID: h.PacketID}))
+	}
+}
+
+// receivedRelease handles a PUBREL packet the server sends to release an inbound QoS 2 packet. The packet identifier
+// is forgotten, so it can be used for a new message, and the release is acknowledged with a PUBCOMP.
+//
+// REQ: MQTT-4.3.3-2
+func (c *Client) receivedRelease(conn *connection, p *packet) {
+	h, ok := p.properties.(PublishRelProperties)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	if session, ok := c.Sessions[c.session]; ok && c.conn == conn {
+		session.state.released(h.PacketID)
+		c.saveSession()
+	}
+	c.lock.Unlock()
+	conn.send(newPacketPublishComp(PublishCompProperties{PacketID: h.PacketID}))
+}
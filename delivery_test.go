@@ -0,0 +1,290 @@
+package wavemq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// connectDeliveries connects a client to the address and creates a publisher on a test topic with the quality of
+// service.
+func connectDeliveries(t *testing.T, client *Client, address string, level int, qos QoSLevel) *Publisher {
+	if _, err := client.Connect(address, ConnectProperties{ProtocolLevel: level, CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	pub, _ := client.PublishOn(Topic{Name: "a/b", Message: ""})
+	pub.Properties.QoSLevel = qos
+	return pub
+}
+
+func TestPublishAtLeastOnce(t *testing.T) {
+	address := (&testServer{Answer: func(conn *connection, p *packet) {
+		if h, ok := p.properties.(PublishProperties); ok {
+			conn.send(newPacketPublishAck(PublishAckProperties{PacketID: h.PacketID}))
+		}
+	}}).start(t)
+	client := Client{Name: "client1"}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel311, QoSAtLeastOnce)
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if err := pub.Send("hello"); err != nil {
+			t.Errorf("The QoS 1 delivery should have completed: %v", err)
+		}
+	}
+	if inFlight := client.Sessions[client.session].state.InFlight; len(inFlight) != 0 {
+		t.Errorf("Acknowledged packets should no longer be in flight, got %v", inFlight)
+	}
+	if used := client.packetIDs.used; len(used) != 0 {
+		t.Errorf("The packet identifiers of acknowledged packets should have been released, got %v", used)
+	}
+}
+
+func TestPublishExactlyOnce(t *testing.T) {
+	released := make(chan uint16, 1)
+	address := (&testServer{Answer: func(conn *connection, p *packet) {
+		switch h := p.properties.(type) {
+		case PublishProperties:
+			conn.send(newPacketPublishRec(PublishRecProperties{PacketID: h.PacketID}))
+		case PublishRelProperties:
+			released <- h.PacketID
+			conn.send(newPacketPublishComp(PublishCompProperties{PacketID: h.PacketID}))
+		}
+	}}).start(t)
+	client := Client{Name: "client1"}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel311, QoSExactlyOnce)
+	defer client.Close()
+	if err := pub.Send("hello"); err != nil {
+		t.Errorf("The QoS 2 delivery should have completed: %v", err)
+	}
+	select {
+	case id := <-released:
+		if id != 1 {
+			t.Errorf("The PUBREL should have released packet 1, got %v", id)
+		}
+	default:
+		t.Errorf("The PUBREC should have been answered with a PUBREL before the PUBCOMP arrived")
+	}
+	if inFlight := client.Sessions[client.session].state.InFlight; len(inFlight) != 0 {
+		t.Errorf("Completed packets should no longer be in flight, got %v", inFlight)
+	}
+}
+
+func TestPublishFailed(t *testing.T) {
+	address := (&testServer{Answer: func(conn *connection, p *packet) {
+		if h, ok := p.properties.(PublishProperties); ok {
+			conn.send(newPacketPublishAck(PublishAckProperties{PacketID: h.PacketID, ReasonCode: ReasonNotAuthorized}))
+		}
+	}}).start(t)
+	client := Client{Name: "client1"}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel5, QoSAtLeastOnce)
+	defer client.Close()
+	if err := pub.Send("hello"); err == nil {
+		t.Errorf("A PUBACK with a failure reason code should have failed the delivery")
+	}
+}
+
+func TestPublishRetry(t *testing.T) {
+	duplicates := make(chan bool, 2)
+	address := (&testServer{Answer: func(conn *connection, p *packet) {
+		if h, ok := p.properties.(PublishProperties); ok {
+			duplicates <- h.DupFlag
+			if h.DupFlag {
+				conn.send(newPacketPublishAck(PublishAckProperties{PacketID: h.PacketID}))
+			}
+		}
+	}}).start(t)
+	client := Client{Name: "client1", RetryInterval: 100 * time.Millisecond}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel311, QoSAtLeastOnce)
+	defer client.Close()
+	if err := pub.Send("hello"); err != nil {
+		t.Errorf("The retransmitted delivery should have completed: %v", err)
+	}
+	if first, second := <-duplicates, <-duplicates; first || !second {
+		t.Errorf("Only the retransmitted PUBLISH should have been marked as a duplicate")
+	}
+}
+
+func TestPublishInterrupted(t *testing.T) {
+	address := (&testServer{Answer: func(conn *connection, p *packet) {}}).start(t)
+	client := Client{Name: "client1"}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel311, QoSAtLeastOnce)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Close()
+	}()
+	if err := pub.Send("hello"); err != ErrDeliveryInterrupted {
+		t.Errorf("Closing the client should have interrupted the delivery, got %v", err)
+	}
+	if inFlight := client.Sessions[client.session].state.InFlight; len(inFlight) != 1 {
+		t.Errorf("The interrupted packet should still be in flight, got %v", inFlight)
+	}
+}
+
+func TestReceivePublish(t *testing.T) {
+	acks := make(chan *packet, 10)
+	server := &testServer{Answer: func(conn *connection, p *packet) {
+		if p.ptype != ptypeSubscribe {
+			acks <- p
+		}
+	}}
+	address := server.start(t)
+	publishes := server.Publishes
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	defer close(publishes)
+	sub, err := client.SubscribeTo(Topic{Name: "a/+", Message: ""}, SubscriberOptions{})
+	if err != nil {
+		t.Fatalf("The client should have subscribed: %v", err)
+	}
+	nextAck := func() *packet {
+		select {
+		case p := <-acks:
+			return p
+		case <-time.After(3 * time.Second):
+			t.Fatalf("The client should have acknowledged the packet")
+			return nil
+		}
+	}
+
+	publish := func(qos QoSLevel, id uint16, dup bool, message string) {
+		h := PublishProperties{QoSLevel: qos, TopicName: "a/b", PacketID: id, DupFlag: dup}
+		publishes <- newPacketPublish(h, []byte(message))
+	}
+	publish(QoSAtMostOnce, 0, false, "zero")
+	publish(QoSAtLeastOnce, 1, false, "one")
+	if p := nextAck(); p.ptype != ptypePuback || p.properties.(PublishAckProperties).PacketID != 1 {
+		t.Errorf("The QoS 1 PUBLISH should have been acknowledged with a PUBACK, got %+v", p.properties)
+	}
+	publish(QoSExactlyOnce, 2, false, "two")
+	if p := nextAck(); p.ptype != ptypePubrec || p.properties.(PublishRecProperties).PacketID != 2 {
+		t.Errorf("The QoS 2 PUBLISH should have been acknowledged with a PUBREC, got %+v", p.properties)
+	}
+	publish(QoSExactlyOnce, 2, true, "two")
+	if p := nextAck(); p.ptype != ptypePubrec {
+		t.Errorf("The duplicate QoS 2 PUBLISH should have been acknowledged with a PUBREC, got %+v", p.properties)
+	}
+	publishes <- newPacketPublishRel(PublishRelProperties{PacketID: 2})
+	if p := nextAck(); p.ptype != ptypePubcomp || p.properties.(PublishCompProperties).PacketID != 2 {
+		t.Errorf("The PUBREL should have been answered with a PUBCOMP, got %+v", p.properties)
+	}
+	publishes <- newPacketPublish(PublishProperties{TopicName: "b/c"}, []byte("other"))
+	publish(QoSAtMostOnce, 0, false, "last")
+
+	for _, expected := range []string{"zero", "one", "two", "last"} {
+		if message := nextMessage(t, sub); message != expected {
+			t.Errorf("The subscriber should have received %q, got %q", expected, message)
+		}
+	}
+}
+
+func TestPublishAsync(t *testing.T) {
+	const count = 1000
+	address := (&testServer{Answer: func() func(conn *connection, p *packet) {
+		var received []uint16
+		return func(conn *connection, p *packet) {
+			h, ok := p.properties.(PublishProperties)
+			if !ok || h.QoSLevel == QoSAtMostOnce {
+				return
+			}
+			// Only acknowledge once every message is in flight, last one first
+			if received = append(received, h.PacketID); len(received) == count {
+				for i := len(received) - 1; i >= 0; i-- {
+					conn.send(newPacketPublishAck(PublishAckProperties{PacketID: received[i]}))
+				}
+			}
+		}
+	}()}).start(t)
+	client := Client{Name: "client1"}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel311, QoSAtLeastOnce)
+	defer client.Close()
+
+	tokens := make([]*PublishToken, count)
+	for i := range tokens {
+		tokens[i] = pub.SendAsync("hello")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for i, token := range tokens {
+		if err := token.Wait(ctx); err != nil {
+			t.Fatalf("Delivery %v should have completed: %v", i, err)
+		}
+		if token.Err() != nil {
+			t.Errorf("A completed delivery should not report an error, got %v", token.Err())
+		}
+	}
+
+	pub.Properties.QoSLevel = QoSAtMostOnce
+	select {
+	case <-pub.SendAsync("hello").Done():
+	default:
+		t.Errorf("A QoS 0 token should be done as soon as the message was sent")
+	}
+	if err := NewPublisher(&Topic{Name: "a/b"}).SendAsync("hello").Err(); err != ErrNoClient {
+		t.Errorf("A token that failed before sending should report the error, got %v", err)
+	}
+}
+
+func TestPublishTokenWait(t *testing.T) {
+	address := (&testServer{Answer: func(conn *connection, p *packet) {}}).start(t)
+	client := Client{Name: "client1"}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel311, QoSExactlyOnce)
+	token := pub.SendAsync("hello")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := token.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Waiting should have stopped with the context, got %v", err)
+	}
+	if token.Err() != nil {
+		t.Errorf("A delivery in progress should not report an error, got %v", token.Err())
+	}
+	client.Close()
+	<-token.Done()
+	if token.Err() != ErrDeliveryInterrupted {
+		t.Errorf("Closing the client should have interrupted the delivery, got %v", token.Err())
+	}
+}
+
+func TestReceivePublishNewSession(t *testing.T) {
+	acks := make(chan *packet, 10)
+	server := &testServer{Connections: 2, Answer: func(conn *connection, p *packet) {
+		if p.ptype == ptypePubrec {
+			acks <- p
+		}
+	}}
+	address := server.start(t)
+	defer close(server.Publishes)
+	client := Client{Name: "client1"}
+	id, err := client.Connect(address, ConnectProperties{})
+	if err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	sub, err := client.SubscribeTo(Topic{Name: "a/b", Message: ""}, SubscriberOptions{})
+	if err != nil {
+		t.Fatalf("The client should have subscribed: %v", err)
+	}
+	publish := func(expected string) {
+		h := PublishProperties{QoSLevel: QoSExactlyOnce, TopicName: "a/b", PacketID: 5}
+		server.Publishes <- newPacketPublish(h, []byte(expected))
+		select {
+		case <-acks:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("The client should have acknowledged the packet")
+		}
+		if message := nextMessage(t, sub); message != expected {
+			t.Errorf("The subscriber should have received %q, got %q", expected, message)
+		}
+	}
+	// The server is gone before it released the packet identifier
+	publish("first")
+	client.Close()
+
+	// The server answers with a new session, so the packet identifier is used for a new message
+	if err = client.Reconnect(id); err != nil {
+		t.Fatalf("The client should have resumed the session: %v", err)
+	}
+	defer client.Close()
+	publish("second")
+}
@@ -0,0 +1,120 @@
+package wavemq
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrKeepAliveTimeout is reported when the other end of a connection went quiet for longer than the keep alive allows.
+// For a client this means the server did not answer a PINGREQ in time.
+var ErrKeepAliveTimeout = errors.New("Connection lost: keep alive timed out")
+
+// keepAliveAction is what a keepAlive decides has to happen once its timer fires.
+type keepAliveAction int
+
+const (
+	keepAliveWait keepAliveAction = iota
+	keepAlivePing
+	keepAliveExpired
+)
+
+// keepAlive keeps track of the activity on a single connection and decides when the keep alive interval that was
+// negotiated in the CONNECT packet requires action. It is used on both ends of a connection:
+//
+// The client side makes sure a control packet is sent at least once per interval by sending a PINGREQ when the
+// connection has been idle, and declares the connection dead when the PINGRESP does not arrive within the timeout.
+//
+// The server side declares the connection dead when nothing has been received from the client for one and a half
+// times the interval.
+//
+// REQ: MQTT-3.1.2-23, MQTT-3.1.2-24
+type keepAlive struct {
+	interval     time.Duration
+	timeout      time.Duration
+	server       bool
+	lock         sync.Mutex
+	lastSent     time.Time
+	lastReceived time.Time
+	pingSent     time.Time
+}
+
+// newKeepAlive creates the client side of a keep alive. A PINGREQ that is not answered within the timeout expires the
+// connection. If the timeout is zero, the interval is used.
+func newKeepAlive(interval time.Duration, timeout time.Duration) *keepAlive {
+	if timeout == 0 {
+		timeout = interval
+	}
+	now := time.Now()
+	return &keepAlive{interval: interval, timeout: timeout, lastSent: now, lastReceived: now}
+}
+
+// newServerKeepAlive creates the server side of a keep alive, which expires the connection when the client has been
+// silent for one and a half times the interval.
+func newServerKeepAlive(interval time.Duration) *keepAlive {
+	now := time.Now()
+	return &keepAlive{interval: interval, server: true, lastSent: now, lastReceived: now}
+}
+
+// sent records that a control packet was sent over the connection.
+func (k *keepAlive) sent(now time.Time) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.lastSent = now
+}
+
+// received records that a control packet of the provided type was received over the connection. A PINGRESP answers
+// the outstanding PINGREQ.
+func (k *keepAlive) received(ptype byte, now time.Time) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.lastReceived = now
+	if ptype == ptypePingresp {
+		k.pingSent = time.Time{}
+	}
+}
+
+// next decides what has to happen at the provided time and how long to wait before checking again. When it decides to
+// ping, the PINGREQ is counted as outstanding from that moment.
+func (k *keepAlive) next(now time.Time) (time.Duration, keepAliveAction) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.server {
+		if wait := k.lastReceived.Add(k.interval * 3 / 2).Sub(now); wait > 0 {
+			return wait, keepAliveWait
+		}
+		return 0, keepAliveExpired
+	}
+	if !k.pingSent.IsZero() {
+		if wait := k.pingSent.Add(k.timeout).Sub(now); wait > 0 {
+			return wait, keepAliveWait
+		}
+		return 0, keepAliveExpired
+	}
+	if wait := k.lastSent.Add(k.interval).Sub(now); wait > 0 {
+		return wait, keepAliveWait
+	}
+	k.pingSent = now
+	return k.timeout, keepAlivePing
+}
+
+// run drives the keep alive until the stop channel is closed. The ping function is called to send a PINGREQ and is
+// only used on the client side. The expire function is called once if the connection is declared dead, or if sending
+// a PINGREQ fails, after which run returns.
+func (k *keepAlive) run(stop <-chan struct{}, ping func() error, expire func()) {
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-timer.C:
+			wait, action := k.next(now)
+			if action == keepAliveExpired || (action == keepAlivePing && ping() != nil) {
+				expire()
+				return
+			}
+			timer.Reset(wait)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package wavemq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveClient(t *testing.T) {
+	k := newKeepAlive(10*time.Second, 2*time.Second)
+	start := k.lastSent
+	if wait, action := k.next(start.Add(4 * time.Second)); action != keepAliveWait || wait != 6*time.Second {
+		t.Errorf("The keep alive should wait 6s before pinging, got %v and %v", wait, action)
+	}
+	k.sent(start.Add(5 * time.Second))
+	if _, action := k.next(start.Add(10 * time.Second)); action != keepAliveWait {
+		t.Errorf("Sending a packet should postpone the PINGREQ, got %v", action)
+	}
+	if wait, action := k.next(start.Add(15 * time.Second)); action != keepAlivePing || wait != 2*time.Second {
+		t.Errorf("The keep alive should ping after an idle interval, got %v and %v", wait, action)
+	}
+	k.sent(start.Add(15 * time.Second))
+	k.received(ptypePingresp, start.Add(16*time.Second))
+	if _, action := k.next(start.Add(17 * time.Second)); action != keepAliveWait {
+		t.Errorf("A PINGRESP should answer the outstanding PINGREQ, got %v", action)
+	}
+
+	k.next(start.Add(30 * time.Second))
+	k.received(ptypePublish, start.Add(31*time.Second))
+	if _, action := k.next(start.Add(32 * time.Second)); action != keepAliveExpired {
+		t.Errorf("A PINGREQ that is not answered within the timeout should expire the connection, got %v", action)
+	}
+}
+
+func TestKeepAliveServer(t *testing.T) {
+	k := newServerKeepAlive(10 * time.Second)
+	start := k.lastReceived
+	if wait, action := k.next(start.Add(10 * time.Second)); action != keepAliveWait || wait != 5*time.Second {
+		t.Errorf("The server should allow one and a half times the keep alive, got %v and %v", wait, action)
+	}
+	k.received(ptypePingreq, start.Add(12*time.Second))
+	if _, action := k.next(start.Add(26 * time.Second)); action != keepAliveWait {
+		t.Errorf("Receiving a packet should postpone the expiry, got %v", action)
+	}
+	if _, action := k.next(start.Add(27 * time.Second)); action != keepAliveExpired {
+		t.Errorf("A silent client should expire, got %v", action)
+	}
+}
+
+func TestKeepAliveRun(t *testing.T) {
+	stop := make(chan struct{})
+	expired := make(chan struct{})
+	pings := 0
+	k := newKeepAlive(10*time.Millisecond, 0)
+	go k.run(stop, func() error {
+		pings++
+		if pings == 1 {
+			k.received(ptypePingresp, time.Now())
+			return nil
+		}
+		return errors.New("write failed")
+	}, func() { close(expired) })
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatalf("A failed PINGREQ should expire the connection")
+	}
+	if pings != 2 {
+		t.Errorf("The keep alive should have pinged twice, got %v", pings)
+	}
+	close(stop)
+}
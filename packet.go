@@ -2,9 +2,11 @@ package wavemq
 
 import (
 	"bytes"
+	"encoding/gob"
 	"errors"
+	"io"
 	"regexp"
-	"unicode"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -52,6 +54,8 @@ const (
 	ptypePingresp byte = 0xD0
 	// ptypeDisconnect is the control packet type for the client disconnecting from the server
 	ptypeDisconnect byte = 0xE0
+	// ptypeAuth is the control packet type for an authentication exchange. It only exists for MQTT 5.0.
+	ptypeAuth byte = 0xF0
 	// pflagsConnect represents the flags associated with the CONNECT control packet type
 	pflagsConnect byte = 0x00
 	// pflagsConnack represents the flags associated with the CONNACK control packet type
@@ -78,6 +82,29 @@ const (
 	pflagsPingresp byte = 0x00
 	// pflagsDisconnect represents the flags associated with the DISCONNECT control packet type
 	pflagsDisconnect byte = 0x00
+	// pflagsAuth represents the flags associated with the AUTH control packet type
+	pflagsAuth byte = 0x00
+)
+
+// The following constants define the protocol levels WaveMQ understands. The protocol level is sent in the variable
+// header of the CONNECT packet and decides the format of every packet sent over the connection afterwards. MQTT 3.1
+// only differs from MQTT 3.1.1 in the CONNECT and CONNACK packets.
+const (
+	// ProtocolLevel31 is the protocol level of MQTT 3.1, which uses the protocol name "MQIsdp"
+	ProtocolLevel31 = 3
+	// ProtocolLevel311 is the protocol level of MQTT 3.1.1
+	ProtocolLevel311 = 4
+	// ProtocolLevel5 is the protocol level of MQTT 5.0
+	ProtocolLevel5 = 5
+)
+
+// The following constants define the protocol names that are sent in the variable header of the CONNECT packet
+// together with the protocol level.
+const (
+	// ProtocolNameMQIsdp is the protocol name used by MQTT 3.1
+	ProtocolNameMQIsdp = "MQIsdp"
+	// ProtocolNameMQTT is the protocol name used by MQTT 3.1.1 and MQTT 5.0
+	ProtocolNameMQTT = "MQTT"
 )
 
 // QoSLevel represents a byte defining the level of quality of service. This is used to restrict the developer to
@@ -99,16 +126,61 @@ const (
 	QoSExactlyOnce QoSLevel = 0x04
 )
 
+// SubscribeReturnCode is the result the server sends back in a SUBACK packet for each topic filter of a SUBSCRIBE
+// request. It is either the maximum quality of service that was granted for the filter or a failure.
+type SubscribeReturnCode byte
+
+// The following constants define the return codes that are allowed in the payload of a SUBACK packet. Unlike
+// QoSLevel, the granted quality of service is not shifted into the position it takes in the PUBLISH flags.
+//
+// REQ: MQTT-3.9.3-2
+const (
+	// SubscribeGrantedAtMostOnce means the subscription was accepted with a maximum QoS of QoSAtMostOnce
+	SubscribeGrantedAtMostOnce SubscribeReturnCode = 0x00
+	// SubscribeGrantedAtLeastOnce means the subscription was accepted with a maximum QoS of QoSAtLeastOnce
+	SubscribeGrantedAtLeastOnce SubscribeReturnCode = 0x01
+	// SubscribeGrantedExactlyOnce means the subscription was accepted with a maximum QoS of QoSExactlyOnce
+	SubscribeGrantedExactlyOnce SubscribeReturnCode = 0x02
+	// SubscribeFailure means the server refused the subscription to the topic filter
+	SubscribeFailure SubscribeReturnCode = 0x80
+)
+
+// Granted returns the maximum quality of service the server granted for the topic filter. The boolean is false if
+// the subscription failed.
+func (c SubscribeReturnCode) Granted() (QoSLevel, bool) {
+	if c > SubscribeGrantedExactlyOnce {
+		return QoSAtMostOnce, false
+	}
+	return QoSLevel(c << 1), true
+}
+
+// TopicSubscription pairs a topic filter with the maximum quality of service requested for it when subscribing. The
+// remaining subscription options are only sent for MQTT 5.0, where RetainHandling is 0 to send retained messages on
+// subscribe, 1 to only send them for a new subscription and 2 to never send them.
+type TopicSubscription struct {
+	Filter            string
+	QoS               QoSLevel
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // Packet Definition
 
-// packet represents a MQTT packet that is either sent or received.
+// packet represents a MQTT packet that is either sent or received. The payload of a PUBLISH packet is application
+// data and is kept as raw bytes for the publisher or subscriber to encode/decode. Payloads of the other control
+// packets have a fixed format and are kept in content instead. The level is the protocol level negotiated for the
+// connection the packet is sent over, which decides between the MQTT 3.1.1 and MQTT 5.0 formats. A zero level means
+// MQTT 3.1.1.
 type packet struct {
 	ptype      byte
 	pflags     byte
+	level      byte
 	length     uint32
 	properties Encodeable
 	payload    []byte
+	content    Encodeable
 	buffer     bytes.Buffer
 }
 
@@ -125,35 +197,79 @@ type packet struct {
 // serialize and deserialize data structures
 type Encodeable interface {
 	Encode() ([]byte, error)
-	//Decode([]byte) (Encodeable, error)
-	// TODO: implement the Decode() function
+}
+
+// Decodeable is the companion of the Encodeable interface and specifies how a structure is to be populated from a
+// slice of bytes produced by its Encode() function. All variable headers and fixed payloads implement this interface
+// with pointer receivers, since decoding modifies the structure.
+//
+// Payloads sent as part of a PUBLISH message can implement this interface together with Encodeable to take over
+// their own deserialization. Without it, WaveMQ will use the 'encode/gob' library.
+type Decodeable interface {
+	Decode([]byte) error
+}
+
+// levelEncodeable is implemented by the variable headers and fixed payloads whose format depends on the protocol level
+// of the connection. Their Encode() and Decode() functions use the MQTT 3.1.1 format, with the exception of the CONNECT
+// types which use the protocol level they carry and the types which only exist for MQTT 5.0.
+type levelEncodeable interface {
+	encode(level byte) ([]byte, error)
 }
 
 // ConnectProperties summarizes the properties found in the variable header of the CONNECT
-// control type packet.
+// control type packet. The protocol level decides the format of the rest of the packet, and of
+// every packet sent over the connection afterwards. If the protocol name is left empty, the name
+// that belongs to the protocol level is sent. The will QoS and will retain flags may only be set
+// together with the will flag, which says the payload carries a will topic and message.
 type ConnectProperties struct {
 	ProtocolName  string
 	ProtocolLevel int
 	CleanSession  bool
 	WillFlag      bool
-	WillQoS       bool
+	WillQoS       QoSLevel
 	WillRetain    bool
 	UserName      bool
 	Password      bool
 	KeepAlive     uint16
+	Properties    *V5Properties
 }
 
 // Encode represents the implementation of the Encodeable interface and describes how the
 // ConnectProperties variable header definition should be encoded in the packet
 func (h ConnectProperties) Encode() (buf []byte, err error) {
+	return h.encode(byte(h.ProtocolLevel))
+}
+
+// encode writes the variable header of a CONNECT control packet. The protocol level of the header
+// itself is always used, whatever level is passed in.
+//
+// REQ: MQTT-3.1.2-13, MQTT-3.1.2-14, MQTT-3.1.2-15, MQTT-3.1.2-22
+func (h ConnectProperties) encode(level byte) (buf []byte, err error) {
 	buffer := bytes.Buffer{}
 	// Write the variable header
-	err = writeIfValidUtf8(&buffer, h.ProtocolName, true)
+	name := h.ProtocolName
+	if name == "" {
+		name = protocolName(h.ProtocolLevel)
+	}
+	if err = checkProtocol(name, h.ProtocolLevel); err != nil {
+		return nil, err
+	}
+	err = writeIfValidUtf8(&buffer, name, true)
 	if err != nil {
 		return nil, err
 	}
+	buffer.WriteByte(byte(h.ProtocolLevel))
 
 	// Check the flags and write it to the buffer
+	if h.WillQoS != QoSAtMostOnce && h.WillQoS != QoSAtLeastOnce && h.WillQoS != QoSExactlyOnce {
+		return nil, errors.New("Invalid will QoS")
+	}
+	if !h.WillFlag && (h.WillQoS != QoSAtMostOnce || h.WillRetain) {
+		return nil, errors.New("Will QoS and will retain must be zero when the will flag is not set")
+	}
+	if h.Password && !h.UserName && h.ProtocolLevel < ProtocolLevel5 {
+		return nil, errors.New("The password flag must be zero when the user name flag is not set")
+	}
 	var flagsByte byte
 	if h.CleanSession {
 		flagsByte |= 0x02
@@ -161,9 +277,7 @@ func (h ConnectProperties) Encode() (buf []byte, err error) {
 	if h.WillFlag {
 		flagsByte |= 0x04
 	}
-	if h.WillQoS {
-		flagsByte |= 0x08
-	}
+	flagsByte |= byte(h.WillQoS) << 2
 	if h.WillRetain {
 		flagsByte |= 0x20
 	}
@@ -176,328 +290,993 @@ func (h ConnectProperties) Encode() (buf []byte, err error) {
 	buffer.WriteByte(flagsByte)
 
 	// Write the keep alive time
-	buffer.WriteByte(byte(h.KeepAlive & 0xF0))
-	buffer.WriteByte(byte(h.KeepAlive & 0x0F))
+	writeUint16(&buffer, h.KeepAlive)
+
+	// Write the properties
+	err = writeProperties(&buffer, h.Properties, byte(h.ProtocolLevel))
+	if err != nil {
+		return nil, err
+	}
 
 	buf = buffer.Bytes()
 
 	return buf, err
 }
 
+// decode reads the variable header of a CONNECT control packet from the buffer into the ConnectProperties struct. The
+// protocol level is read from the header itself, so the level that is passed in is ignored.
+//
+// REQ: MQTT-3.1.2-3, MQTT-3.1.2-11, MQTT-3.1.2-13, MQTT-3.1.2-15, MQTT-3.1.2-22
+func (h *ConnectProperties) decode(buf *bytes.Buffer, _ byte) (err error) {
+	if h.ProtocolName, err = readString(buf); err != nil {
+		return err
+	}
+	level, err := buf.ReadByte()
+	if err != nil {
+		return errors.New("Malformed CONNECT variable header: missing protocol level")
+	}
+	h.ProtocolLevel = int(level)
+	if err = checkProtocol(h.ProtocolName, h.ProtocolLevel); err != nil {
+		return err
+	}
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return errors.New("Malformed CONNECT variable header: missing connect flags")
+	}
+	if flags&0x01 != 0 {
+		return errors.New("The reserved connect flag must be set to zero")
+	}
+	if flags&0x18 == 0x18 {
+		return errors.New("Invalid will QoS in the connect flags")
+	}
+	h.CleanSession = flags&0x02 != 0
+	h.WillFlag = flags&0x04 != 0
+	h.WillQoS = QoSLevel(flags&0x18) >> 2
+	h.WillRetain = flags&0x20 != 0
+	h.Password = flags&0x40 != 0
+	h.UserName = flags&0x80 != 0
+	if !h.WillFlag && flags&0x38 != 0 {
+		return errors.New("Will QoS and will retain must be zero when the will flag is not set")
+	}
+	if !h.UserName && h.Password && level < ProtocolLevel5 {
+		return errors.New("The password flag must be zero when the user name flag is not set")
+	}
+	if h.KeepAlive, err = readUint16(buf); err != nil {
+		return err
+	}
+	h.Properties, err = readProperties(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a CONNECT message from the byte slice into the ConnectProperties struct. This is
+// an implementation of the Decodeable interface.
+func (h *ConnectProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
+}
+
+// protocolName returns the protocol name that is sent together with the protocol level in a CONNECT packet.
+func protocolName(level int) string {
+	if level == ProtocolLevel31 {
+		return ProtocolNameMQIsdp
+	}
+	return ProtocolNameMQTT
+}
+
+// checkProtocol verifies that WaveMQ supports the protocol level and that the protocol name is the one that belongs to
+// it. MQTT 3.1 is identified by the name "MQIsdp", later levels by "MQTT".
+//
+// REQ: MQTT-3.1.2-1, MQTT-3.1.2-2
+func checkProtocol(name string, level int) error {
+	if level != ProtocolLevel31 && level != ProtocolLevel311 && level != ProtocolLevel5 {
+		return errors.New("Unsupported protocol level")
+	}
+	if name != protocolName(level) {
+		return errors.New("The protocol name does not match the protocol level")
+	}
+	return nil
+}
+
+// NewPayload creates an empty CONNECT payload that belongs to this variable header. Its Decode function will expect
+// exactly the optional fields that the connect flags of the header say are present.
+func (h ConnectProperties) NewPayload() ConnectPayload {
+	return ConnectPayload{header: h}
+}
+
 // ConnectPayload defines the attributes of the payload for a CONNECT control packet. These
-// values will be encoded as length-prefixed fields
+// values will be encoded as length-prefixed fields. The will properties, topic and message are
+// only sent when the will flag of the header is set, and the will properties only for MQTT 5.0.
+// The will message is written like any other value: byte slices as they are, an Encodeable by
+// its own Encode function and anything else with the 'encoding/gob' package. A decoded will
+// message is always a byte slice.
 type ConnectPayload struct {
-	Identifier  string
-	WillTopic   string
-	WillMessage interface{}
-	UserName    string
-	Password    []byte
+	Identifier     string
+	WillProperties *V5Properties
+	WillTopic      string
+	WillMessage    interface{}
+	UserName       string
+	Password       []byte
+	header         ConnectProperties
 }
 
 // Encode writes the payload content for a CONNECT control packet, which has a specific format. This is an
 // implementation of the Encodeable interface.
 func (p ConnectPayload) Encode() ([]byte, error) {
+	return p.encode(byte(p.header.ProtocolLevel))
+}
+
+// encode writes the payload content for a CONNECT control packet in the format of the provided protocol level.
+//
+// REQ: MQTT-3.1.2-9, MQTT-3.1.2-11, MQTT-3.1.2-18, MQTT-3.1.2-19, MQTT-3.1.2-20, MQTT-3.1.2-21
+func (p ConnectPayload) encode(level byte) ([]byte, error) {
 	buffer := bytes.Buffer{}
 
 	// Encode the identifier after verifying it is valid
-	matched, err := regexp.MatchString("[^A-Za-z0-9]+", p.Identifier)
-	if matched || err != nil {
-		return nil, errors.New("Client identifier must only contain characters A-Z, a-z, or a number")
-	} else if l := len(p.Identifier); 1 <= l && l <= 23 {
-		return nil, errors.New("Client identifier must be between 1 and 23 bytes")
+	err := p.checkIdentifier(level)
+	if err != nil {
+		return nil, err
 	}
 	err = writeIfValidUtf8(&buffer, p.Identifier, true)
 	if err != nil {
 		return nil, err
 	}
 
-	// Encode the will topic
-	if len(p.WillTopic) != 0 {
+	// Encode the will properties, topic and message, which must be present exactly when the will flag is set
+	if !p.header.WillFlag && (len(p.WillTopic) != 0 || p.WillMessage != nil) {
+		return nil, errors.New("A will topic and message can only be sent when the will flag is set")
+	}
+	if p.header.WillFlag {
+		if err = checkTopicName(p.WillTopic); err != nil {
+			return nil, err
+		}
+		err = writeProperties(&buffer, p.WillProperties, level)
+		if err != nil {
+			return nil, err
+		}
 		err = writeIfValidUtf8(&buffer, p.WillTopic, true)
 		if err != nil {
 			return nil, err
 		}
+		message := p.WillMessage
+		if message == nil {
+			message = []byte{}
+		}
+		err = writeInterface(&buffer, message)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Encode the will message
-	if len(p.WillMessage) != 0 {
-		err = writeIfValidUtf8(&buffer, p.WillMessage, true)
+	// Encode the user name and password, which must be present exactly when their flags are set
+	if !p.header.UserName && len(p.UserName) != 0 {
+		return nil, errors.New("A user name can only be sent when the user name flag is set")
+	}
+	if !p.header.Password && p.Password != nil {
+		return nil, errors.New("A password can only be sent when the password flag is set")
+	}
+	if p.header.UserName {
+		err = writeIfValidUtf8(&buffer, p.UserName, true)
+		if err != nil {
+			return nil, errors.New("Invalid UTF-8 encoded user name")
+		}
+	}
+	if p.header.Password {
+		err = writeInterface(&buffer, p.Password)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Encode the user name
-	if !utf8.ValidString(p.UserName) {
-		return nil, errors.New("Invalid UTF-8 encoded user name")
+	return buffer.Bytes(), err
+}
+
+// checkIdentifier verifies the client identifier against the rules of the protocol level. MQTT 3.1 allows 1 to 23
+// characters of any kind. Later levels only guarantee that a server accepts up to 23 letters and digits, but they
+// allow an empty identifier to have the server assign one, which before MQTT 5.0 also requires a clean session.
+//
+// REQ: MQTT-3.1.3-5, MQTT-3.1.3-7
+func (p ConnectPayload) checkIdentifier(level byte) error {
+	if level == ProtocolLevel31 {
+		if l := utf8.RuneCountInString(p.Identifier); l < 1 || l > 23 {
+			return errors.New("Client identifier must be between 1 and 23 characters")
+		}
+		return nil
+	}
+	matched, err := regexp.MatchString("[^A-Za-z0-9]+", p.Identifier)
+	if matched || err != nil {
+		return errors.New("Client identifier must only contain characters A-Z, a-z, or a number")
+	} else if len(p.Identifier) > 23 {
+		return errors.New("Client identifier must be at most 23 bytes")
+	} else if len(p.Identifier) == 0 && level < ProtocolLevel5 && !p.header.CleanSession {
+		return errors.New("An empty client identifier requires a clean session")
 	}
-	bytes = []byte(p.UserName)
-	length = uint16(len(bytes))
-	buffer.WriteByte(byte(length & 0xF0))
-	buffer.WriteByte(byte(length & 0x0F))
-	buffer.Write(bytes)
+	return nil
+}
 
-	// Encode the password
-	length = uint16(len(p.Password))
-	buffer.WriteByte(byte(length & 0xF0))
-	buffer.WriteByte(byte(length & 0x0F))
-	buffer.Write(p.Password)
+// decode reads the payload of a CONNECT control packet from the buffer. Which of the optional fields are present is
+// determined by the flags in the variable header, so the decoded header must be provided.
+//
+// REQ: MQTT-3.1.3-1
+func (p *ConnectPayload) decode(buf *bytes.Buffer, h ConnectProperties) (err error) {
+	if p.Identifier, err = readString(buf); err != nil {
+		return err
+	}
+	if h.WillFlag {
+		if p.WillProperties, err = readProperties(buf, byte(h.ProtocolLevel)); err != nil {
+			return err
+		}
+		if p.WillTopic, err = readString(buf); err != nil {
+			return err
+		}
+		if p.WillMessage, err = readBinary(buf); err != nil {
+			return err
+		}
+	}
+	if h.UserName {
+		if p.UserName, err = readString(buf); err != nil {
+			return err
+		}
+	}
+	if h.Password {
+		if p.Password, err = readBinary(buf); err != nil {
+			return err
+		}
+	}
+	p.header = h
+	return nil
+}
 
-	return buf, err
+// Decode reads the payload of a CONNECT message from the byte slice into the ConnectPayload struct. The connect
+// flags of the variable header the payload was sent with decide which fields are present, so they are taken from
+// the header the payload was created with (see ConnectProperties.NewPayload). This is an implementation of the
+// Decodeable interface.
+func (p *ConnectPayload) Decode(b []byte) error {
+	h := p.header
+	return decodeAll(b, byte(h.ProtocolLevel), func(buf *bytes.Buffer, _ byte) error {
+		return p.decode(buf, h)
+	})
 }
 
 // ConnectAckProperties summarizes the properties found in the variable header of the CONNECTACK
-// control type packet
+// control type packet. For MQTT 5.0 the return code holds a ReasonCode. MQTT 3.1 has no session
+// present flag, so it is neither sent nor read for that protocol level.
 type ConnectAckProperties struct {
 	SessionPresent bool
 	ReturnCode     int
+	Properties     *V5Properties
 }
 
 // Encode represents the implementation of the Encodeable interface and describes how the
 // ConnectAckProperties variable header definition should be encoded in the packet
 func (h ConnectAckProperties) Encode() (buf []byte, err error) {
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a CONNACK control packet in the format of the provided protocol level.
+func (h ConnectAckProperties) encode(level byte) (buf []byte, err error) {
 	buffer := bytes.Buffer{}
 	flags := byte(0x00)
-	if h.SessionPresent {
+	if h.SessionPresent && level != ProtocolLevel31 {
 		flags |= 0x01
 	}
 	buffer.WriteByte(flags)
 	buffer.WriteByte(byte(h.ReturnCode))
+	if err = writeProperties(&buffer, h.Properties, level); err != nil {
+		return nil, err
+	}
 	buf = buffer.Bytes()
 
 	return buf, err
 }
 
+// decode reads the variable header of a CONNACK control packet from the buffer into the ConnectAckProperties struct.
+//
+// REQ: MQTT-3.2.2-1
+func (h *ConnectAckProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return errors.New("Malformed CONNACK variable header: missing acknowledge flags")
+	}
+	if level == ProtocolLevel31 {
+		flags = 0x00
+	} else if flags&0xFE != 0 {
+		return errors.New("The reserved connect acknowledge flags must be set to zero")
+	}
+	code, err := buf.ReadByte()
+	if err != nil {
+		return errors.New("Malformed CONNACK variable header: missing return code")
+	}
+	h.SessionPresent = flags&0x01 != 0
+	h.ReturnCode = int(code)
+	h.Properties, err = readProperties(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a CONNACK message from the byte slice into the ConnectAckProperties struct. This
+// is an implementation of the Decodeable interface.
+func (h *ConnectAckProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
+}
+
 // PublishProperties summarizes the properties found in the variable header of the PUBLISH control type packet. It also
 // includes the control packet flags since these can be set dynamically by the client/server (as oppsed to all the
 // other packets who have fixed control type flags).
 type PublishProperties struct {
-	DupFlag   bool
-	QoSLevel  QoSLevel
-	Retain    bool
-	TopicName string
-	PacketID  uint16
+	DupFlag    bool
+	QoSLevel   QoSLevel
+	Retain     bool
+	TopicName  string
+	PacketID   uint16
+	Properties *V5Properties
 }
 
 // Encode writes the fields of the PublishProperties struct to a properly formated byte buffer that can be used as
 // the variable header for a PUBLISH control packet.
 func (h PublishProperties) Encode() (buf []byte, err error) {
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a PUBLISH control packet in the format of the provided protocol level.
+func (h PublishProperties) encode(level byte) (buf []byte, err error) {
 	buffer := bytes.Buffer{}
 	// encode the topic name
-	topicNameBytes := []byte(h.TopicName)
-	topicNameLength := uint16(len(topicNameBytes))
-	buffer.WriteByte(byte(topicNameLength & 0xF0))
-	buffer.WriteByte(byte(topicNameLength & 0x0F))
+	err = writeIfValidUtf8(&buffer, h.TopicName, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode the packet ID, which is only present for QoS 1 and 2
+	if h.QoSLevel != QoSAtMostOnce {
+		writeUint16(&buffer, h.PacketID)
+	}
 
-	// Encode the packet ID
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
+	// Encode the properties
+	if err = writeProperties(&buffer, h.Properties, level); err != nil {
+		return nil, err
+	}
 
 	buf = buffer.Bytes()
 
 	return buf, err
 }
 
+// decode reads the variable header of a PUBLISH control packet from the buffer. The flags from the fixed header must
+// already be set on the struct since the quality of service determines whether a packet identifier is present.
+//
+// REQ: MQTT-3.3.2-2
+func (h *PublishProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	if h.TopicName, err = readString(buf); err != nil {
+		return err
+	}
+	if strings.ContainsAny(h.TopicName, "#+") {
+		return errors.New("The topic name of a PUBLISH packet must not contain wildcard characters")
+	}
+	if h.QoSLevel != QoSAtMostOnce {
+		if h.PacketID, err = readUint16(buf); err != nil {
+			return err
+		}
+	}
+	h.Properties, err = readProperties(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a PUBLISH message from the byte slice into the PublishProperties struct. Since
+// the packet identifier is only present for QoS 1 and 2, QoSLevel must be set from the fixed header before calling
+// Decode. This is an implementation of the Decodeable interface.
+func (h *PublishProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
+}
+
 // PublishAckProperties defines the fields of the variable header for a PUBACK packet.
 type PublishAckProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of a PUBACK message to byte buffer with fields as defined by the PubAckProperties
 // struct. This is an implementation of the Encodeable interface.
 func (h PublishAckProperties) Encode() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a PUBACK control packet in the format of the provided protocol level.
+func (h PublishAckProperties) encode(level byte) (buf []byte, err error) {
+	return encodeAck(h.PacketID, h.ReasonCode, h.Properties, level)
+}
+
+// decode reads the variable header of a PUBACK control packet from the buffer into the PublishAckProperties struct.
+func (h *PublishAckProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.ReasonCode, h.Properties, err = decodeAck(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a PUBACK message from the byte slice into the PublishAckProperties struct. This
+// is an implementation of the Decodeable interface.
+func (h *PublishAckProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
 }
 
 // PublishRecProperties defines the fields of the variable header for the PUBREC packet.
 type PublishRecProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of a PUBREC message to a byte buffer using the fields and values from the
 // PublishRecProperties struct. This is an implementation of the Encodeable interface.
 func (h PublishRecProperties) Encode() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a PUBREC control packet in the format of the provided protocol level.
+func (h PublishRecProperties) encode(level byte) (buf []byte, err error) {
+	return encodeAck(h.PacketID, h.ReasonCode, h.Properties, level)
+}
+
+// decode reads the variable header of a PUBREC control packet from the buffer into the PublishRecProperties struct.
+func (h *PublishRecProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.ReasonCode, h.Properties, err = decodeAck(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a PUBREC message from the byte slice into the PublishRecProperties struct. This
+// is an implementation of the Decodeable interface.
+func (h *PublishRecProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
 }
 
 // PublishRelProperties defines the fields of the variable header for the PUBREL packet
 type PublishRelProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of the PUBREL message to a byte buffer using the fields and values from the
 // PublishRelProperties struct. This is an implementation of the Encodeable interface.
 func (h PublishRelProperties) Encode() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a PUBREL control packet in the format of the provided protocol level.
+func (h PublishRelProperties) encode(level byte) (buf []byte, err error) {
+	return encodeAck(h.PacketID, h.ReasonCode, h.Properties, level)
+}
+
+// decode reads the variable header of a PUBREL control packet from the buffer into the PublishRelProperties struct.
+func (h *PublishRelProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.ReasonCode, h.Properties, err = decodeAck(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a PUBREL message from the byte slice into the PublishRelProperties struct. This
+// is an implementation of the Decodeable interface.
+func (h *PublishRelProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
 }
 
 // PublishCompProperties defines the fields of the variable header for a PUBCOMP packet.
 type PublishCompProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of the PUBCOMP message to a byte buffer using the fields and values from the
 // PublishCompProperties struct. This is an implementation of the Encodeable interface.
 func (h PublishCompProperties) Encode() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a PUBCOMP control packet in the format of the provided protocol level.
+func (h PublishCompProperties) encode(level byte) (buf []byte, err error) {
+	return encodeAck(h.PacketID, h.ReasonCode, h.Properties, level)
+}
+
+// decode reads the variable header of a PUBCOMP control packet from the buffer into the PublishCompProperties struct.
+func (h *PublishCompProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.ReasonCode, h.Properties, err = decodeAck(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a PUBCOMP message from the byte slice into the PublishCompProperties struct. This
+// is an implementation of the Decodeable interface.
+func (h *PublishCompProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
 }
 
 // SubscribeProperties defines the fields of the variable header for a SUBSCRIBE control packet.
 type SubscribeProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of the SUBSCRIBE message to a byte buffer using the fields and values from the
 // SubscribeProperties struct. This is an implementation of the Encodeable interface.
 func (h SubscribeProperties) Encode() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a SUBSCRIBE control packet in the format of the provided protocol level.
+func (h SubscribeProperties) encode(level byte) (buf []byte, err error) {
+	return encodeIdentified(h.PacketID, h.Properties, level)
+}
+
+// decode reads the variable header of a SUBSCRIBE control packet from the buffer into the SubscribeProperties struct.
+func (h *SubscribeProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.Properties, err = decodeIdentified(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a SUBSCRIBE message from the byte slice into the SubscribeProperties struct. This
+// is an implementation of the Decodeable interface.
+func (h *SubscribeProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
 }
 
-// SubscribePayload defines the payload of a SUBSCRIBE packet
+// SubscribePayload defines the payload of a SUBSCRIBE packet. The order of the topics is kept on the wire since the
+// return codes of the matching SUBACK are sent in the same order.
 type SubscribePayload struct {
-	Topics map[string]QoSLevel
+	Topics []TopicSubscription
 }
 
 // Encode writes the payload of the SUBSCRIBE message to a byte buffer using the fields and values from the
 // SubscribePayload struct. This is an implementation of the Encodeable interface.
 func (p SubscribePayload) Encode() (buf []byte, err error) {
+	return p.encode(ProtocolLevel311)
+}
+
+// encode writes the payload of a SUBSCRIBE control packet in the format of the provided protocol level. The
+// subscription options other than the quality of service are only sent for MQTT 5.0.
+func (p SubscribePayload) encode(level byte) (buf []byte, err error) {
 	if len(p.Topics) == 0 {
 		err = errors.New("SUBSCRIBE payload must have at least one topic/quality of service pair")
 		return nil, err
 	}
 	buffer := bytes.Buffer{}
-	for topic, qos := range p.Topics {
-		if !utf8.ValidString(topic) {
-			return nil, errors.New("Invalid UTF-8 encoded topic")
+	for _, topic := range p.Topics {
+		if err = writeIfValidUtf8(&buffer, topic.Filter, true); err != nil {
+			return nil, err
+		}
+		options := byte(topic.QoS) >> 1
+		if level >= ProtocolLevel5 {
+			if topic.NoLocal {
+				options |= 0x04
+			}
+			if topic.RetainAsPublished {
+				options |= 0x08
+			}
+			options |= (topic.RetainHandling & 0x03) << 4
 		}
-		buf = []byte(topic)
-		buflen := uint16(len(buf))
-		buffer.WriteByte(byte(buflen & 0xF0))
-		buffer.WriteByte(byte(buflen & 0x0F))
-		buffer.Write(buf)
-		buffer.WriteByte(byte(qos) >> 1)
+		buffer.WriteByte(options)
 	}
 	return buffer.Bytes(), err
 }
 
+// decode reads the topic filter/quality of service pairs of a SUBSCRIBE payload from the buffer until it is empty.
+//
+// REQ: MQTT-3.8.3-3, MQTT-3.8.3-4
+func (p *SubscribePayload) decode(buf *bytes.Buffer, level byte) error {
+	p.Topics = nil
+	for buf.Len() > 0 {
+		topic, err := readString(buf)
+		if err != nil {
+			return err
+		}
+		options, err := buf.ReadByte()
+		if err != nil {
+			return errors.New("Malformed SUBSCRIBE payload: missing requested quality of service")
+		}
+		reserved := byte(0xFC)
+		if level >= ProtocolLevel5 {
+			reserved = 0xC0
+		}
+		if options&reserved != 0 || options&0x03 > 2 || (options>>4)&0x03 > 2 {
+			return errors.New("Malformed SUBSCRIBE payload: invalid subscription options")
+		}
+		p.Topics = append(p.Topics, TopicSubscription{
+			Filter:            topic,
+			QoS:               QoSLevel((options & 0x03) << 1),
+			NoLocal:           options&0x04 != 0,
+			RetainAsPublished: options&0x08 != 0,
+			RetainHandling:    (options >> 4) & 0x03,
+		})
+	}
+	if len(p.Topics) == 0 {
+		return errors.New("SUBSCRIBE payload must have at least one topic/quality of service pair")
+	}
+	return nil
+}
+
+// Decode reads the payload of a SUBSCRIBE message from the byte slice into the SubscribePayload struct. This is an
+// implementation of the Decodeable interface.
+func (p *SubscribePayload) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, p.decode)
+}
+
 // SubscribeAckProperties defines the fields of the variable header for a SUBACK control packet.
 type SubscribeAckProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of the SUBACK message to a byte buffer using the fields and values from the
 // SubscribeAckProperties struct. This is an implementation of the Encodeable interface.
 func (h SubscribeAckProperties) Encode() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of a SUBACK control packet in the format of the provided protocol level.
+func (h SubscribeAckProperties) encode(level byte) (buf []byte, err error) {
+	return encodeIdentified(h.PacketID, h.Properties, level)
 }
 
-// SubscribeAckPayload defines the payload of the SUBACK packet, which comprises of a list of topics and their
-// quality of service levels matching the ones sent in the original SUBSCRIBE request.
+// decode reads the variable header of a SUBACK control packet from the buffer into the SubscribeAckProperties struct.
+func (h *SubscribeAckProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.Properties, err = decodeIdentified(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a SUBACK message from the byte slice into the SubscribeAckProperties struct. This
+// is an implementation of the Decodeable interface.
+func (h *SubscribeAckProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
+}
+
+// SubscribeAckPayload defines the payload of the SUBACK packet, which comprises of a list of return codes. There is
+// one return code for each topic filter in the original SUBSCRIBE request, in the same order as the request. For
+// MQTT 5.0 the return codes are reason codes, which have more ways to report a failure.
 type SubscribeAckPayload struct {
-	Topics map[string]QoSLevel
+	ReturnCodes []SubscribeReturnCode
 }
 
 // Encode writes the payload of the SUBACK message to a byte buffer using the fields and values from the
 // SubscribeAckPayload struct. This is an implementation of the Encodeable interface.
 func (p SubscribeAckPayload) Encode() (buf []byte, err error) {
-	if len(p.Topics) == 0 {
-		err = errors.New("SUBACK payload must have at least one topic/quality of service pair")
+	if len(p.ReturnCodes) == 0 {
+		err = errors.New("SUBACK payload must have at least one return code")
 		return nil, err
 	}
-	buffer := bytes.Buffer{}
-	for topic, qos := range p.Topics {
-		if !utf8.ValidString(topic) {
-			return nil, errors.New("Invalid UTF-8 encoded topic")
+	buf = make([]byte, len(p.ReturnCodes))
+	for i, code := range p.ReturnCodes {
+		buf[i] = byte(code)
+	}
+	return buf, err
+}
+
+// decode reads the return codes of a SUBACK payload from the buffer, making sure each one is allowed by the protocol.
+//
+// REQ: MQTT-3.9.3-2
+func (p *SubscribeAckPayload) decode(buf *bytes.Buffer, level byte) error {
+	codes := buf.Next(buf.Len())
+	if len(codes) == 0 {
+		return errors.New("SUBACK payload must have at least one return code")
+	}
+	p.ReturnCodes = make([]SubscribeReturnCode, len(codes))
+	for i, code := range codes {
+		p.ReturnCodes[i] = SubscribeReturnCode(code)
+		if p.ReturnCodes[i] <= SubscribeGrantedExactlyOnce || p.ReturnCodes[i] == SubscribeFailure {
+			continue
+		}
+		switch ReasonCode(code) {
+		case ReasonImplementationSpecificError, ReasonNotAuthorized, ReasonTopicFilterInvalid,
+			ReasonPacketIdentifierInUse, ReasonQuotaExceeded, ReasonSharedSubscriptionsNotSupported,
+			ReasonSubscriptionIdentifiersNotSupported, ReasonWildcardSubscriptionsNotSupported:
+			if level >= ProtocolLevel5 {
+				continue
+			}
 		}
-		buf = []byte(topic)
-		buflen := uint16(len(buf))
-		buffer.WriteByte(byte(buflen & 0xF0))
-		buffer.WriteByte(byte(buflen & 0x0F))
-		buffer.Write(buf)
-		buffer.WriteByte(byte(qos) >> 1)
+		return errors.New("Malformed SUBACK payload: invalid return code")
 	}
-	return buffer.Bytes(), err
+	return nil
+}
+
+// Decode reads the payload of a SUBACK message from the byte slice into the SubscribeAckPayload struct. This is an
+// implementation of the Decodeable interface.
+func (p *SubscribeAckPayload) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, p.decode)
 }
 
 // UnsubscribeProperties defines the fields of the variable header for a UNSUBSCRIBE control packet.
 type UnsubscribeProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of the UNSUBSCRIBE message to a byte buffer using the fields and values from the
 // SubscribeProperties struct. This is an implementation of the Encodeable interface.
 func (h UnsubscribeProperties) Encode() (buf []byte, err error) {
-	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of an UNSUBSCRIBE control packet in the format of the provided protocol level.
+func (h UnsubscribeProperties) encode(level byte) (buf []byte, err error) {
+	return encodeIdentified(h.PacketID, h.Properties, level)
+}
+
+// decode reads the variable header of a UNSUBSCRIBE control packet from the buffer into the UnsubscribeProperties
+// struct.
+func (h *UnsubscribeProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.Properties, err = decodeIdentified(buf, level)
+	return err
+}
+
+// Decode reads the variable header of an UNSUBSCRIBE message from the byte slice into the UnsubscribeProperties struct.
+// This is an implementation of the Decodeable interface.
+func (h *UnsubscribeProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
 }
 
-// UnsubscribePayload defines the payload of a UNSUBSCRIBE packet
+// UnsubscribePayload defines the payload of a UNSUBSCRIBE packet, which only carries topic filters. There is no
+// quality of service associated with unsubscribing.
 type UnsubscribePayload struct {
-	Topics map[string]QoSLevel
+	Topics []string
 }
 
 // Encode writes the payload of the UNSUBSCRIBE message to a byte buffer using the fields and values from the
 // UnsubscribePayload struct. This is an implementation of the Encodeable interface.
 func (p UnsubscribePayload) Encode() (buf []byte, err error) {
 	if len(p.Topics) == 0 {
-		err = errors.New("SUBSCRIBE payload must have at least one topic/quality of service pair")
+		err = errors.New("UNSUBSCRIBE payload must have at least one topic")
 		return nil, err
 	}
 	buffer := bytes.Buffer{}
-	for topic, qos := range p.Topics {
-		if !utf8.ValidString(topic) {
-			return nil, errors.New("Invalid UTF-8 encoded topic")
+	for _, topic := range p.Topics {
+		if err = writeIfValidUtf8(&buffer, topic, true); err != nil {
+			return nil, err
 		}
-		buf = []byte(topic)
-		buflen := uint16(len(buf))
-		buffer.WriteByte(byte(buflen & 0xF0))
-		buffer.WriteByte(byte(buflen & 0x0F))
-		buffer.Write(buf)
-		buffer.WriteByte(byte(qos) >> 1)
 	}
 	return buffer.Bytes(), err
 }
 
+// decode reads the topic filters of an UNSUBSCRIBE payload from the buffer until it is empty.
+//
+// REQ: MQTT-3.10.3-2
+func (p *UnsubscribePayload) decode(buf *bytes.Buffer, _ byte) error {
+	p.Topics = nil
+	for buf.Len() > 0 {
+		topic, err := readString(buf)
+		if err != nil {
+			return err
+		}
+		p.Topics = append(p.Topics, topic)
+	}
+	if len(p.Topics) == 0 {
+		return errors.New("UNSUBSCRIBE payload must have at least one topic")
+	}
+	return nil
+}
+
+// Decode reads the payload of an UNSUBSCRIBE message from the byte slice into the UnsubscribePayload struct. This is an
+// implementation of the Decodeable interface.
+func (p *UnsubscribePayload) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, p.decode)
+}
+
 // UnsubscribeAckProperties defines the fields of the variable header for a UNSUBACK control packet.
 type UnsubscribeAckProperties struct {
-	PacketID uint16
+	PacketID   uint16
+	Properties *V5Properties
 }
 
 // Encode writes the variable header of the UNSUBACK message to a byte buffer using the fields and values from the
 // UnsubscribeAckProperties struct. This is an implementation of the Encodeable interface.
 func (h UnsubscribeAckProperties) Encode() (buf []byte, err error) {
+	return h.encode(ProtocolLevel311)
+}
+
+// encode writes the variable header of an UNSUBACK control packet in the format of the provided protocol level.
+func (h UnsubscribeAckProperties) encode(level byte) (buf []byte, err error) {
+	return encodeIdentified(h.PacketID, h.Properties, level)
+}
+
+// decode reads the variable header of a UNSUBACK control packet from the buffer into the UnsubscribeAckProperties
+// struct.
+func (h *UnsubscribeAckProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.PacketID, h.Properties, err = decodeIdentified(buf, level)
+	return err
+}
+
+// Decode reads the variable header of an UNSUBACK message from the byte slice into the UnsubscribeAckProperties struct.
+// This is an implementation of the Decodeable interface.
+func (h *UnsubscribeAckProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel311, h.decode)
+}
+
+// UnsubscribeAckPayload defines the payload of an UNSUBACK packet. It only exists for MQTT 5.0, where there is one
+// reason code for each topic filter in the original UNSUBSCRIBE request, in the same order as the request.
+type UnsubscribeAckPayload struct {
+	ReasonCodes []ReasonCode
+}
+
+// Encode writes the payload of the UNSUBACK message to a byte buffer using the fields and values from the
+// UnsubscribeAckPayload struct. This is an implementation of the Encodeable interface.
+func (p UnsubscribeAckPayload) Encode() (buf []byte, err error) {
+	return p.encode(ProtocolLevel5)
+}
+
+// encode writes the payload of an UNSUBACK control packet, which is empty before MQTT 5.0.
+func (p UnsubscribeAckPayload) encode(level byte) (buf []byte, err error) {
+	if level < ProtocolLevel5 {
+		return nil, nil
+	}
+	if len(p.ReasonCodes) == 0 {
+		return nil, errors.New("UNSUBACK payload must have at least one reason code")
+	}
+	buf = make([]byte, len(p.ReasonCodes))
+	for i, code := range p.ReasonCodes {
+		buf[i] = byte(code)
+	}
+	return buf, nil
+}
+
+// decode reads the reason codes of an UNSUBACK payload from the buffer, making sure each one is allowed by the
+// protocol.
+func (p *UnsubscribeAckPayload) decode(buf *bytes.Buffer, _ byte) error {
+	codes := buf.Next(buf.Len())
+	if len(codes) == 0 {
+		return errors.New("UNSUBACK payload must have at least one reason code")
+	}
+	p.ReasonCodes = make([]ReasonCode, len(codes))
+	for i, code := range codes {
+		p.ReasonCodes[i] = ReasonCode(code)
+		switch p.ReasonCodes[i] {
+		case ReasonSuccess, ReasonNoSubscriptionExisted, ReasonUnspecifiedError, ReasonImplementationSpecificError,
+			ReasonNotAuthorized, ReasonTopicFilterInvalid, ReasonPacketIdentifierInUse:
+		default:
+			return errors.New("Malformed UNSUBACK payload: invalid reason code")
+		}
+	}
+	return nil
+}
+
+// Decode reads the payload of an UNSUBACK message from the byte slice into the UnsubscribeAckPayload struct. This is
+// an implementation of the Decodeable interface.
+func (p *UnsubscribeAckPayload) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel5, p.decode)
+}
+
+// DisconnectProperties defines the fields of the variable header for a DISCONNECT control packet. The variable header
+// is empty before MQTT 5.0.
+type DisconnectProperties struct {
+	ReasonCode ReasonCode
+	Properties *V5Properties
+}
+
+// Encode writes the variable header of the DISCONNECT message to a byte buffer using the fields and values from the
+// DisconnectProperties struct. This is an implementation of the Encodeable interface.
+func (h DisconnectProperties) Encode() (buf []byte, err error) {
+	return h.encode(ProtocolLevel5)
+}
+
+// encode writes the variable header of a DISCONNECT control packet in the format of the provided protocol level.
+func (h DisconnectProperties) encode(level byte) (buf []byte, err error) {
+	return encodeReason(h.ReasonCode, h.Properties, level)
+}
+
+// decode reads the variable header of a DISCONNECT control packet from the buffer into the DisconnectProperties
+// struct.
+func (h *DisconnectProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.ReasonCode, h.Properties, err = decodeReason(buf, level)
+	return err
+}
+
+// Decode reads the variable header of a DISCONNECT message from the byte slice into the DisconnectProperties struct.
+// This is an implementation of the Decodeable interface.
+func (h *DisconnectProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel5, h.decode)
+}
+
+// AuthProperties defines the fields of the variable header for an AUTH control packet, which only exists for MQTT 5.0.
+type AuthProperties struct {
+	ReasonCode ReasonCode
+	Properties *V5Properties
+}
+
+// Encode writes the variable header of the AUTH message to a byte buffer using the fields and values from the
+// AuthProperties struct. This is an implementation of the Encodeable interface.
+func (h AuthProperties) Encode() (buf []byte, err error) {
+	return h.encode(ProtocolLevel5)
+}
+
+// encode writes the variable header of an AUTH control packet.
+func (h AuthProperties) encode(level byte) (buf []byte, err error) {
+	return encodeReason(h.ReasonCode, h.Properties, level)
+}
+
+// decode reads the variable header of an AUTH control packet from the buffer into the AuthProperties struct.
+func (h *AuthProperties) decode(buf *bytes.Buffer, level byte) (err error) {
+	h.ReasonCode, h.Properties, err = decodeReason(buf, level)
+	return err
+}
+
+// Decode reads the variable header of an AUTH message from the byte slice into the AuthProperties struct. This is an
+// implementation of the Decodeable interface.
+func (h *AuthProperties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel5, h.decode)
+}
+
+// encodeAck writes the variable header shared by the PUBACK, PUBREC, PUBREL and PUBCOMP control packets. For MQTT 5.0
+// the reason code and properties follow the packet identifier, but they are left out when there is nothing to say
+// beyond a successful acknowledgement.
+func encodeAck(packetID uint16, reason ReasonCode, props *V5Properties, level byte) ([]byte, error) {
 	buffer := bytes.Buffer{}
-	buffer.WriteByte(byte(h.PacketID & 0xF0))
-	buffer.WriteByte(byte(h.PacketID & 0x0F))
-	buf = buffer.Bytes()
-	return buf, err
+	writeUint16(&buffer, packetID)
+	if level >= ProtocolLevel5 && (reason != ReasonSuccess || props != nil) {
+		buffer.WriteByte(byte(reason))
+		if props != nil {
+			if err := writeProperties(&buffer, props, level); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodeAck reads the variable header shared by the PUBACK, PUBREC, PUBREL and PUBCOMP control packets. A missing
+// reason code means success and missing properties mean there are none.
+func decodeAck(buf *bytes.Buffer, level byte) (packetID uint16, reason ReasonCode, props *V5Properties, err error) {
+	if packetID, err = readUint16(buf); err != nil {
+		return 0, 0, nil, err
+	}
+	if level < ProtocolLevel5 || buf.Len() == 0 {
+		return packetID, ReasonSuccess, nil, nil
+	}
+	code, _ := buf.ReadByte()
+	if buf.Len() > 0 {
+		props, err = readProperties(buf, level)
+	}
+	return packetID, ReasonCode(code), props, err
+}
+
+// encodeIdentified writes the variable header shared by the SUBSCRIBE, SUBACK, UNSUBSCRIBE and UNSUBACK control
+// packets, which is a packet identifier followed by the properties for MQTT 5.0.
+func encodeIdentified(packetID uint16, props *V5Properties, level byte) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	writeUint16(&buffer, packetID)
+	if err := writeProperties(&buffer, props, level); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodeIdentified reads the variable header shared by the SUBSCRIBE, SUBACK, UNSUBSCRIBE and UNSUBACK control
+// packets.
+func decodeIdentified(buf *bytes.Buffer, level byte) (packetID uint16, props *V5Properties, err error) {
+	if packetID, err = readUint16(buf); err != nil {
+		return 0, nil, err
+	}
+	props, err = readProperties(buf, level)
+	return packetID, props, err
+}
+
+// encodeReason writes the variable header shared by the DISCONNECT and AUTH control packets. It is empty before
+// MQTT 5.0, and also for MQTT 5.0 when the reason code is success and there are no properties.
+func encodeReason(reason ReasonCode, props *V5Properties, level byte) ([]byte, error) {
+	if level < ProtocolLevel5 || (reason == ReasonSuccess && props == nil) {
+		return nil, nil
+	}
+	buffer := bytes.Buffer{}
+	buffer.WriteByte(byte(reason))
+	if props != nil {
+		if err := writeProperties(&buffer, props, level); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodeReason reads the variable header shared by the DISCONNECT and AUTH control packets.
+func decodeReason(buf *bytes.Buffer, level byte) (reason ReasonCode, props *V5Properties, err error) {
+	if level < ProtocolLevel5 || buf.Len() == 0 {
+		return ReasonSuccess, nil, nil
+	}
+	code, _ := buf.ReadByte()
+	if buf.Len() > 0 {
+		props, err = readProperties(buf, level)
+	}
+	return ReasonCode(code), props, err
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -509,13 +1288,13 @@ func (h UnsubscribeAckProperties) Encode() (buf []byte, err error) {
 // REQ: MQTT-1.5.3-1
 func writeIfValidUtf8(buf *bytes.Buffer, s string, writeLength bool) error {
 	if writeLength {
-		length := uint16(len(s))
-		buf.WriteByte(byte(length & 0xF0))
-		buf.WriteByte(byte(length & 0x0F))
+		if len(s) > 0xFFFF {
+			return errors.New("String is too long to be written with a two byte length prefix")
+		}
+		writeUint16(buf, uint16(len(s)))
 	}
-	for c := range s {
-		r := rune(c)
-		if !utf8.ValidRune(r) {
+	for _, r := range s {
+		if !utf8.ValidRune(r) || r == utf8.RuneError {
 			return errors.New("Invalid UTF-8 encoded string")
 		} else if r == 0 {
 			return errors.New("The encoding of the NULL character (U-000) is not allowed in MQTT")
@@ -530,10 +1309,33 @@ func writeIfValidUtf8(buf *bytes.Buffer, s string, writeLength bool) error {
 // writeInterface will write the struct passed as the value paramter to the provided buffer. The value interface MAY
 // implement the Encodeable interface, in which case it will have an Encode() function defined on it. If this is the
 // case, this function will encode the value using that function. If there is no Encode() function defined on the
-// provided value, then this function will use the "encoding/gob" package to encode the value.
+// provided value, then this function will use the "encoding/gob" package to encode the value. Byte slices are written
+// as they are. In every case the encoded value is prefixed with its two byte length.
 //
 // REQ: MQTT-1.5.3-1
 func writeInterface(buf *bytes.Buffer, value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case Encodeable:
+		var err error
+		if data, err = v.Encode(); err != nil {
+			return err
+		}
+	default:
+		encoded := bytes.Buffer{}
+		if err := gob.NewEncoder(&encoded).Encode(value); err != nil {
+			return err
+		}
+		data = encoded.Bytes()
+	}
+	if len(data) > 0xFFFF {
+		return errors.New("Encoded value is too long to be written with a two byte length prefix")
+	}
+	length := uint16(len(data))
+	writeUint16(buf, length)
+	buf.Write(data)
 	return nil
 }
 
@@ -544,84 +1346,149 @@ func writeInterface(buf *bytes.Buffer, value interface{}) error {
 //
 // REQ: MQTT-1.5.3-1
 func readIfValidUtf8(buf *bytes.Buffer, size int) (string, error) {
-	runes := make([]rune, 1)
-	for size > 0 {
-		r, s, err := buf.ReadRune()
-		if err != nil {
-			return "", err
-		} else if r == 0 {
+	if buf.Len() < size {
+		return "", errors.New("Malformed packet: string is longer than the remaining bytes")
+	}
+	b := buf.Next(size)
+	if !utf8.Valid(b) {
+		return "", errors.New("Invalid UTF-8 encoded rune encountered")
+	}
+	s := string(b)
+	for _, r := range s {
+		if r == 0 {
 			return "", errors.New("The encoding the the NULL character (U-000) is not allowed in MQTT")
-		} else if r == unicode.ReplacementChar {
-			return "", errors.New("Invalid UTF-8 encoded rune encountered")
 		} else if r <= 31 || (127 <= r && r <= 159) {
 			return "", errors.New("UTF-8 control characters are not allowed in MQTT")
 		}
-		runes = append(runes, r)
-		size -= s
 	}
-	return string(runes), nil
+	return s, nil
+}
+
+// writeUint16 writes a two byte integer to the buffer in big-endian (network) byte order, which is how MQTT encodes
+// every two byte field: packet identifiers, the keep alive and the length prefix of strings and binary data.
+func writeUint16(buf *bytes.Buffer, value uint16) {
+	buf.WriteByte(byte(value >> 8))
+	buf.WriteByte(byte(value))
+}
+
+// readUint16 reads a two byte integer in big-endian (network) byte order from the buffer, returning an error if there
+// are not enough bytes left. It is the counterpart of writeUint16.
+func readUint16(buf *bytes.Buffer) (uint16, error) {
+	b := buf.Next(2)
+	if len(b) != 2 {
+		return 0, errors.New("Malformed packet: not enough bytes for a two byte integer")
+	}
+	return uint16(b[0])<<8 | uint16(b[1]), nil
+}
+
+// readString reads a length-prefixed UTF-8 encoded string from the buffer.
+//
+// REQ: MQTT-1.5.3-1
+func readString(buf *bytes.Buffer) (string, error) {
+	size, err := readUint16(buf)
+	if err != nil {
+		return "", err
+	}
+	return readIfValidUtf8(buf, int(size))
+}
+
+// readBinary reads length-prefixed binary data from the buffer. The returned slice is a copy, so it remains valid
+// after the buffer is reused.
+func readBinary(buf *bytes.Buffer) ([]byte, error) {
+	size, err := readUint16(buf)
+	if err != nil {
+		return nil, err
+	}
+	b := buf.Next(int(size))
+	if len(b) != int(size) {
+		return nil, errors.New("Malformed packet: binary data is longer than the remaining bytes")
+	}
+	return append([]byte{}, b...), nil
+}
+
+// decodeAll runs the provided decode function over the whole byte slice and makes sure that every byte was consumed.
+// It is used to implement the Decodeable interface on top of the buffer based decode functions used by packet.decode.
+func decodeAll(b []byte, level byte, decode func(*bytes.Buffer, byte) error) error {
+	buf := bytes.NewBuffer(b)
+	if err := decode(buf, level); err != nil {
+		return err
+	}
+	if buf.Len() != 0 {
+		return errors.New("Malformed packet: unexpected bytes after the last field")
+	}
+	return nil
 }
 
 // encodeRemainingLength operates on a pointer a packet struct by modifying its internal buffer
 // to contain the provided length value in the encoded format specified in the MQTT protocol
 // specifications. It will also update the internal offset of the packet so that the rest of
-// the packet can be created. This function should only be called when building a packet to send
+// the packet can be created. This function should only be called when building a packet to send.
+// A length of zero is still encoded as a single byte.
 func encodeRemainingLength(length uint32) []byte {
-	buf := make([]byte, 0)
+	buf := make([]byte, 0, 4)
 	var encoded byte
-	for length > 0 {
+	for {
 		encoded = byte(length % 0x80)
 		length /= 0x80
 		if length > 0 {
 			encoded |= 0x80
 		}
 		buf = append(buf, encoded)
+		if length == 0 {
+			return buf
+		}
 	}
-	return buf
 }
 
-// decodeRemainingLength looks at a packet's internal buffer and decodes the value of the
-// remaining length s. It also updates the internal read offset by first setting it to 1 (the
-// expected location of the start of the remaining length s) and incrementing it so that it
-// ends at the start of the variable length header or payload (depending on the packet type)
+// decodeRemainingLength decodes the value of the remaining length from the start of the provided
+// slice, which should begin with the byte that follows the control byte of a packet. An error is
+// returned if the slice ends before the remaining length does or if the encoding is malformed.
 func decodeRemainingLength(buf []byte) (value uint32, err error) {
-	var multiplier uint32 = 1
-	var encoded byte
-	var index = 0
-	first := true
-	for (encoded&0x80) != 0 || first {
-		if first {
-			first = false
-		}
-		encoded = buf[index]
-		index++
+	value, err = readRemainingLength(bytes.NewReader(buf))
+	if err == io.EOF {
+		err = errors.New("Malformed remaining length: not enough bytes")
+	}
+	return value, err
+}
+
+// readRemainingLength reads the variable length encoding of the remaining length one byte at a time from the
+// provided reader. At most four bytes are read, and anything longer is reported as malformed.
+func readRemainingLength(r io.ByteReader) (value uint32, err error) {
+	for i := uint(0); i < 4; i++ {
+		encoded, err := r.ReadByte()
 		if err != nil {
 			return 0, err
 		}
-		value += uint32(encoded&0x7F) * multiplier
-		multiplier *= 128
-		if multiplier > 128*128*128 {
-			err = errors.New("Malformed remaining length")
-			return 0, err
+		value |= uint32(encoded&0x7F) << (7 * i)
+		if encoded&0x80 == 0 {
+			return value, nil
 		}
 	}
-	return value, err
+	return 0, errors.New("Malformed remaining length")
 }
 
 // encode writes the information in the packet to the internal buffer in preparation for
 // delivery.
-// TODO: when encoding, we need to make sure that byte order will not be a problem across hosts (use network order)
 func (p *packet) encode() (err error) {
 	// Reset the buffer in case it has already been written or a previous attempt failed
 	p.buffer.Reset()
 	var length uint32
 	// Encode the variable header and payload in temporary buffers so that we know their length,
 	// but make sure we only include the payload if there is supposed to be one (and is one)
-	vheaderBytes, err := p.properties.Encode()
-	if err != nil {
-		return err
+	var vheaderBytes []byte
+	if p.properties != nil {
+		vheaderBytes, err = encodeLevel(p.properties, p.protocolLevel())
+		if err != nil {
+			return err
+		}
 	}
 	length += uint32(len(vheaderBytes))
+	if p.content != nil {
+		p.payload, err = encodeLevel(p.content, p.protocolLevel())
+		if err != nil {
+			return err
+		}
+	}
 	if p.payload != nil {
 		length += uint32(len(p.payload))
 	}
@@ -643,18 +1510,219 @@ func (p *packet) encode() (err error) {
 	return err
 }
 
+// protocolLevel returns the protocol level the packet is encoded with, defaulting to MQTT 3.1.1.
+func (p *packet) protocolLevel() byte {
+	if p.level == 0 {
+		return ProtocolLevel311
+	}
+	return p.level
+}
+
+// encodeLevel encodes the value in the format of the provided protocol level if its format depends on it, and with
+// its Encode() function otherwise.
+func encodeLevel(value Encodeable, level byte) ([]byte, error) {
+	if v, ok := value.(levelEncodeable); ok {
+		return v.encode(level)
+	}
+	return value.Encode()
+}
+
 // decode attempts to populate the fields in the packet by deserializing the encoded slice of
-// bytes passed in as a function argument.
+// bytes passed in as a function argument. The slice must contain exactly one control packet. The
+// variable header is decoded into the matching properties struct and, for the control packets that
+// have a fixed payload format, the payload is decoded into content. PUBLISH payloads are left as
+// raw bytes in payload.
+//
+// The packet is decoded in the format of its protocol level, except for CONNECT which carries the
+// protocol level itself. The level of a decoded CONNECT packet is set to the one it requested.
 func (p *packet) decode(buffer []byte) (err error) {
-	return err
+	if len(buffer) < 2 {
+		return errors.New("Malformed packet: missing fixed header")
+	}
+	p.ptype = buffer[0] & 0xF0
+	p.pflags = buffer[0] & 0x0F
+	if err = checkFlags(p.ptype, p.pflags); err != nil {
+		return err
+	}
+
+	reader := bytes.NewReader(buffer[1:])
+	p.length, err = readRemainingLength(reader)
+	if err != nil {
+		return err
+	}
+	if uint32(reader.Len()) != p.length {
+		return errors.New("Malformed packet: remaining length does not match the number of bytes received")
+	}
+	body := bytes.NewBuffer(buffer[len(buffer)-reader.Len():])
+	p.properties = nil
+	p.payload = nil
+	p.content = nil
+	level := p.protocolLevel()
+	if p.ptype == ptypeAuth && level < ProtocolLevel5 {
+		return errors.New("Malformed packet: AUTH is only allowed for MQTT 5.0")
+	}
+
+	switch p.ptype {
+	case ptypeConnect:
+		h := ConnectProperties{}
+		if err = h.decode(body, level); err != nil {
+			return err
+		}
+		c := ConnectPayload{}
+		if err = c.decode(body, h); err != nil {
+			return err
+		}
+		p.properties, p.content = h, c
+		p.level = byte(h.ProtocolLevel)
+	case ptypeConnack:
+		h := ConnectAckProperties{}
+		err = h.decode(body, level)
+		p.properties = h
+	case ptypePublish:
+		h := PublishProperties{
+			DupFlag:  p.pflags&0x08 != 0,
+			QoSLevel: QoSLevel(p.pflags & 0x06),
+			Retain:   p.pflags&0x01 != 0,
+		}
+		if err = h.decode(body, level); err != nil {
+			return err
+		}
+		p.properties = h
+		p.payload = body.Next(body.Len())
+	case ptypePuback:
+		h := PublishAckProperties{}
+		err = h.decode(body, level)
+		p.properties = h
+	case ptypePubrec:
+		h := PublishRecProperties{}
+		err = h.decode(body, level)
+		p.properties = h
+	case ptypePubrel:
+		h := PublishRelProperties{}
+		err = h.decode(body, level)
+		p.properties = h
+	case ptypePubcomp:
+		h := PublishCompProperties{}
+		err = h.decode(body, level)
+		p.properties = h
+	case ptypeSubscribe:
+		h := SubscribeProperties{}
+		if err = h.decode(body, level); err != nil {
+			return err
+		}
+		c := SubscribePayload{}
+		if err = c.decode(body, level); err != nil {
+			return err
+		}
+		p.properties, p.content = h, c
+	case ptypeSuback:
+		h := SubscribeAckProperties{}
+		if err = h.decode(body, level); err != nil {
+			return err
+		}
+		c := SubscribeAckPayload{}
+		if err = c.decode(body, level); err != nil {
+			return err
+		}
+		p.properties, p.content = h, c
+	case ptypeUnsubscribe:
+		h := UnsubscribeProperties{}
+		if err = h.decode(body, level); err != nil {
+			return err
+		}
+		c := UnsubscribePayload{}
+		if err = c.decode(body, level); err != nil {
+			return err
+		}
+		p.properties, p.content = h, c
+	case ptypeUnsuback:
+		h := UnsubscribeAckProperties{}
+		if err = h.decode(body, level); err != nil {
+			return err
+		}
+		p.properties = h
+		if level >= ProtocolLevel5 {
+			c := UnsubscribeAckPayload{}
+			err = c.decode(body, level)
+			p.content = c
+		}
+	case ptypeDisconnect:
+		h := DisconnectProperties{}
+		err = h.decode(body, level)
+		p.properties = h
+	case ptypeAuth:
+		h := AuthProperties{}
+		err = h.decode(body, level)
+		p.properties = h
+	case ptypePingreq, ptypePingresp:
+		// These packets have no variable header or payload
+	}
+	if err != nil {
+		return err
+	}
+	if body.Len() != 0 {
+		return errors.New("Malformed packet: unexpected bytes after the end of the packet")
+	}
+	return nil
+}
+
+// checkFlags verifies that the flags in the first byte of a control packet are the ones reserved for its type. The
+// only packet that has flags which are not fixed is PUBLISH, where the quality of service bits must not both be set.
+//
+// REQ: MQTT-2.2.2-1, MQTT-2.2.2-2, MQTT-3.3.1-4
+func checkFlags(ptype byte, pflags byte) error {
+	var reserved byte
+	switch ptype {
+	case ptypeConnect:
+		reserved = pflagsConnect
+	case ptypeConnack:
+		reserved = pflagsConnack
+	case ptypePublish:
+		if pflags&0x06 == 0x06 {
+			return errors.New("Malformed PUBLISH packet: both quality of service bits are set")
+		}
+		return nil
+	case ptypePuback:
+		reserved = pflagsPuback
+	case ptypePubrec:
+		reserved = pflagsPubrec
+	case ptypePubrel:
+		reserved = pflagsPubrel
+	case ptypePubcomp:
+		reserved = pflagsPubcomp
+	case ptypeSubscribe:
+		reserved = pflagsSubscribe
+	case ptypeSuback:
+		reserved = pflagsSuback
+	case ptypeUnsubscribe:
+		reserved = pflagsUnsubscribe
+	case ptypeUnsuback:
+		reserved = pflagsUnsuback
+	case ptypePingreq:
+		reserved = pflagsPingreq
+	case ptypePingresp:
+		reserved = pflagsPingresp
+	case ptypeDisconnect:
+		reserved = pflagsDisconnect
+	case ptypeAuth:
+		reserved = pflagsAuth
+	default:
+		return errors.New("Malformed packet: reserved control packet type")
+	}
+	if pflags != reserved {
+		return errors.New("Malformed packet: invalid flags for the control packet type")
+	}
+	return nil
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 // Packet Construction/Initialization
 
-// newPacketConnect creates a new CONNECT packet ready to be encoded and sent over the network
+// newPacketConnect creates a new CONNECT packet ready to be encoded and sent over the network. The payload is tied to
+// the variable header so that its identifier is checked against the rules of the right protocol level.
 func newPacketConnect(properties ConnectProperties, payload ConnectPayload) *packet {
-	return &packet{ptype: ptypeConnect, pflags: pflagsConnect, properties: properties, payload: payload.Encode()}
+	payload.header = properties
+	return &packet{ptype: ptypeConnect, pflags: pflagsConnect, properties: properties, content: payload}
 }
 
 // newPacketConnectAck creates a new CONNECT packet ready to be encoded and sent over the network
@@ -696,22 +1764,23 @@ func newPacketPublishComp(properties PublishCompProperties) *packet {
 
 // newPacketSubscribe creates a new SUBSCRIBE packet ready to be encoded and sent over the network
 func newPacketSubscribe(properties SubscribeProperties, payload SubscribePayload) *packet {
-	return &packet{ptype: ptypeSubscribe, pflags: pflagsSubscribe, properties: properties, payload: payload.Encode()}
+	return &packet{ptype: ptypeSubscribe, pflags: pflagsSubscribe, properties: properties, content: payload}
 }
 
 // newPacketSubscribeAck creates a new SUBACK packet ready to be encoded and sent over the network
 func newPacketSubscribeAck(properties SubscribeAckProperties, payload SubscribeAckPayload) *packet {
-	return &packet{ptype: ptypeSuback, pflags: pflagsSuback, properties: properties, payload: payload.Encode()}
+	return &packet{ptype: ptypeSuback, pflags: pflagsSuback, properties: properties, content: payload}
 }
 
 // newPacketSubscribe creates a new UNSUBCRIBE packet ready to be encoded and sent over the network
-func newPacketUnsubscribe(properties UnsubscribePayload, payload UnsubscribePayload) *packet {
-	return &packet{ptype: ptypeUnsubscribe, pflags: pflagsUnsubscribe, properties: properties, payload: payload.Encode()}
+func newPacketUnsubscribe(properties UnsubscribeProperties, payload UnsubscribePayload) *packet {
+	return &packet{ptype: ptypeUnsubscribe, pflags: pflagsUnsubscribe, properties: properties, content: payload}
 }
 
-// newPacketUnsubscribeAck creates a new UNSUBACK packet ready to be encoded and sent over the network
-func newPacketUnsubscribeAck(properties UnsubscribeAckPayload) *packet {
-	return &packet{ptype: ptypeUnsuback, pflags: pflagsUnsuback, properties: properties}
+// newPacketUnsubscribeAck creates a new UNSUBACK packet ready to be encoded and sent over the network. The payload is
+// only sent for MQTT 5.0.
+func newPacketUnsubscribeAck(properties UnsubscribeAckProperties, payload UnsubscribeAckPayload) *packet {
+	return &packet{ptype: ptypeUnsuback, pflags: pflagsUnsuback, properties: properties, content: payload}
 }
 
 // newPacketPingReq creates a new PINGREQ packet ready to be encoded and sent over the network
@@ -725,6 +1794,11 @@ func newPacketPingResp() *packet {
 }
 
 // newPacketDisconnect creates a new DISCONNECT packet ready to be encoded and sent over the network
-func newPacketDisconnect() {
-	return &packet{ptype: ptypeDisconnect, pflags: pflagsDisconnect}
+func newPacketDisconnect(properties DisconnectProperties) *packet {
+	return &packet{ptype: ptypeDisconnect, pflags: pflagsDisconnect, properties: properties}
+}
+
+// newPacketAuth creates a new AUTH packet ready to be encoded and sent over the network
+func newPacketAuth(properties AuthProperties) *packet {
+	return &packet{ptype: ptypeAuth, pflags: pflagsAuth, properties: properties}
 }
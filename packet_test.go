@@ -1,6 +1,9 @@
 package wavemq
 
 import (
+	"bytes"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -36,3 +39,606 @@ func TestEncodeRemainingLength(t *testing.T) {
 	}
 
 }
+
+func TestDecodeConnect(t *testing.T) {
+	buf := []byte{
+		0x10, 0x16,
+		0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xC2, 0x00, 0x3C,
+		0x00, 0x03, 'a', 'b', 'c',
+		0x00, 0x01, 'u',
+		0x00, 0x02, 'p', 'w',
+	}
+	p := packet{}
+	if err := p.decode(buf); err != nil {
+		t.Fatalf("An error occurred while decoding the CONNECT packet: %v", err)
+	}
+	h, ok := p.properties.(ConnectProperties)
+	if !ok {
+		t.Fatalf("The properties were decoded as %T instead of ConnectProperties", p.properties)
+	}
+	if h.ProtocolName != "MQTT" || h.ProtocolLevel != 4 || !h.CleanSession || !h.UserName || !h.Password {
+		t.Errorf("The variable header was decoded incorrectly: %+v", h)
+	}
+	if h.KeepAlive != 60 {
+		t.Errorf("The keep alive was decoded incorrectly. Expected 60 and got %v", h.KeepAlive)
+	}
+	c, ok := p.content.(ConnectPayload)
+	if !ok {
+		t.Fatalf("The payload was decoded as %T instead of ConnectPayload", p.content)
+	}
+	if c.Identifier != "abc" || c.UserName != "u" || string(c.Password) != "pw" {
+		t.Errorf("The payload was decoded incorrectly: %+v", c)
+	}
+
+	// The reserved connect flag must be zero
+	buf[9] |= 0x01
+	if err := p.decode(buf); err == nil {
+		t.Errorf("There should have been an error because the reserved connect flag was set")
+	}
+}
+
+func TestDecodePublish(t *testing.T) {
+	buf := []byte{0x3B, 0x09, 0x00, 0x03, 'a', '/', 'b', 0x01, 0x02, 'h', 'i'}
+	p := packet{}
+	if err := p.decode(buf); err != nil {
+		t.Fatalf("An error occurred while decoding the PUBLISH packet: %v", err)
+	}
+	h := p.properties.(PublishProperties)
+	if !h.DupFlag || h.QoSLevel != QoSAtLeastOnce || !h.Retain {
+		t.Errorf("The fixed header flags were decoded incorrectly: %+v", h)
+	}
+	if h.TopicName != "a/b" || h.PacketID != 258 {
+		t.Errorf("The variable header was decoded incorrectly: %+v", h)
+	}
+	if string(p.payload) != "hi" {
+		t.Errorf("The payload was decoded incorrectly. Expected 'hi' and got '%s'", p.payload)
+	}
+
+	// QoS 0 packets do not have a packet identifier
+	buf = []byte{0x30, 0x07, 0x00, 0x03, 'a', '/', 'b', 'h', 'i'}
+	if err := p.decode(buf); err != nil {
+		t.Fatalf("An error occurred while decoding the PUBLISH packet: %v", err)
+	}
+	if h = p.properties.(PublishProperties); h.PacketID != 0 || string(p.payload) != "hi" {
+		t.Errorf("The QoS 0 packet was decoded incorrectly: %+v %s", h, p.payload)
+	}
+
+	// Topic names must not contain wildcards
+	buf = []byte{0x30, 0x07, 0x00, 0x03, 'a', '/', '#', 'h', 'i'}
+	if err := p.decode(buf); err == nil {
+		t.Errorf("There should have been an error because the topic name contained a wildcard")
+	}
+}
+
+func TestDecodeSubscribe(t *testing.T) {
+	buf := []byte{0x82, 0x08, 0x00, 0x0A, 0x00, 0x03, 'a', '/', '#', 0x01}
+	p := packet{}
+	if err := p.decode(buf); err != nil {
+		t.Fatalf("An error occurred while decoding the SUBSCRIBE packet: %v", err)
+	}
+	if h := p.properties.(SubscribeProperties); h.PacketID != 10 {
+		t.Errorf("The packet identifier was decoded incorrectly. Expected 10 and got %v", h.PacketID)
+	}
+	if c := p.content.(SubscribePayload); len(c.Topics) != 1 || c.Topics[0].Filter != "a/#" ||
+		c.Topics[0].QoS != QoSAtLeastOnce {
+		t.Errorf("The topics were decoded incorrectly: %v", c.Topics)
+	}
+
+	buf = []byte{0x90, 0x04, 0x00, 0x0A, 0x01, 0x80}
+	if err := p.decode(buf); err != nil {
+		t.Fatalf("An error occurred while decoding the SUBACK packet: %v", err)
+	}
+	if c := p.content.(SubscribeAckPayload); len(c.ReturnCodes) != 2 || c.ReturnCodes[1] != SubscribeFailure {
+		t.Errorf("The return codes were decoded incorrectly: %v", c.ReturnCodes)
+	}
+
+	buf = []byte{0xA2, 0x07, 0x00, 0x0B, 0x00, 0x03, 'a', '/', '#'}
+	if err := p.decode(buf); err != nil {
+		t.Fatalf("An error occurred while decoding the UNSUBSCRIBE packet: %v", err)
+	}
+	if c := p.content.(UnsubscribePayload); len(c.Topics) != 1 || c.Topics[0] != "a/#" {
+		t.Errorf("The topics were decoded incorrectly: %v", c.Topics)
+	}
+}
+
+func TestDecodeFixedSize(t *testing.T) {
+	tests := map[string][]byte{
+		"CONNACK":    {0x20, 0x02, 0x01, 0x00},
+		"PUBACK":     {0x40, 0x02, 0x00, 0x01},
+		"PUBREC":     {0x50, 0x02, 0x00, 0x01},
+		"PUBREL":     {0x62, 0x02, 0x00, 0x01},
+		"PUBCOMP":    {0x70, 0x02, 0x00, 0x01},
+		"UNSUBACK":   {0xB0, 0x02, 0x00, 0x01},
+		"PINGREQ":    {0xC0, 0x00},
+		"PINGRESP":   {0xD0, 0x00},
+		"DISCONNECT": {0xE0, 0x00},
+	}
+	for name, buf := range tests {
+		p := packet{}
+		if err := p.decode(buf); err != nil {
+			t.Errorf("An error occurred while decoding the %v packet: %v", name, err)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"reserved type":        {0x00, 0x00},
+		"PUBREL flags":         {0x60, 0x02, 0x00, 0x01},
+		"SUBSCRIBE flags":      {0x80, 0x08, 0x00, 0x0A, 0x00, 0x03, 'a', '/', '#', 0x01},
+		"PUBLISH QoS":          {0x36, 0x07, 0x00, 0x03, 'a', '/', 'b', 'h', 'i'},
+		"short length":         {0x40, 0x02, 0x00},
+		"trailing bytes":       {0xC0, 0x01, 0x00},
+		"SUBACK return code":   {0x90, 0x03, 0x00, 0x0A, 0x03},
+		"empty SUBSCRIBE":      {0x82, 0x02, 0x00, 0x0A},
+		"split character":      {0x30, 0x05, 0x00, 0x01, 0xC3, 0xA9, 'x'},
+		"missing fixed header": {0xC0},
+	}
+	for name, buf := range tests {
+		p := packet{}
+		if err := p.decode(buf); err == nil {
+			t.Errorf("There should have been an error decoding the malformed packet (%v)", name)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	connect := ConnectProperties{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 4,
+		CleanSession:  true,
+		WillFlag:      true,
+		WillQoS:       QoSAtLeastOnce,
+		UserName:      true,
+		Password:      true,
+		KeepAlive:     10,
+	}
+	connectPayload := connect.NewPayload()
+	connectPayload.Identifier = "client1"
+	connectPayload.WillTopic = "will"
+	connectPayload.WillMessage = []byte("gone")
+	connectPayload.UserName = "user"
+	connectPayload.Password = []byte("secret")
+
+	tests := []struct {
+		name    string
+		encoded Encodeable
+		decoded Decodeable
+	}{
+		{"ConnectProperties", connect, &ConnectProperties{}},
+		{"ConnectPayload", connectPayload, &ConnectPayload{header: connect}},
+		{"ConnectAckProperties", ConnectAckProperties{SessionPresent: true, ReturnCode: 5}, &ConnectAckProperties{}},
+		{"PublishProperties", PublishProperties{QoSLevel: QoSExactlyOnce, TopicName: "a/b", PacketID: 9},
+			&PublishProperties{QoSLevel: QoSExactlyOnce}},
+		{"PublishAckProperties", PublishAckProperties{PacketID: 1}, &PublishAckProperties{}},
+		{"PublishRecProperties", PublishRecProperties{PacketID: 2}, &PublishRecProperties{}},
+		{"PublishRelProperties", PublishRelProperties{PacketID: 3}, &PublishRelProperties{}},
+		{"PublishCompProperties", PublishCompProperties{PacketID: 4}, &PublishCompProperties{}},
+		{"SubscribeProperties", SubscribeProperties{PacketID: 5}, &SubscribeProperties{}},
+		{"SubscribePayload", SubscribePayload{Topics: []TopicSubscription{
+			{Filter: "a/+", QoS: QoSAtLeastOnce}, {Filter: "b/#", QoS: QoSExactlyOnce}}}, &SubscribePayload{}},
+		{"SubscribeAckProperties", SubscribeAckProperties{PacketID: 6}, &SubscribeAckProperties{}},
+		{"SubscribeAckPayload", SubscribeAckPayload{ReturnCodes: []SubscribeReturnCode{0x00, 0x02, 0x80}},
+			&SubscribeAckPayload{}},
+		{"UnsubscribeProperties", UnsubscribeProperties{PacketID: 7}, &UnsubscribeProperties{}},
+		{"UnsubscribePayload", UnsubscribePayload{Topics: []string{"a/+", "b/#"}}, &UnsubscribePayload{}},
+		{"UnsubscribeAckProperties", UnsubscribeAckProperties{PacketID: 8}, &UnsubscribeAckProperties{}},
+	}
+	for _, test := range tests {
+		buf, err := test.encoded.Encode()
+		if err != nil {
+			t.Errorf("An error occurred while encoding %v: %v", test.name, err)
+			continue
+		}
+		if err = test.decoded.Decode(buf); err != nil {
+			t.Errorf("An error occurred while decoding %v: %v", test.name, err)
+			continue
+		}
+		result := reflect.ValueOf(test.decoded).Elem().Interface()
+		if !reflect.DeepEqual(test.encoded, result) {
+			t.Errorf("The %v result was incorrect. Encoded %+v and decoded %+v", test.name, test.encoded, result)
+		}
+	}
+}
+
+func TestDecodeTrailingBytes(t *testing.T) {
+	h := PublishAckProperties{}
+	if err := h.Decode([]byte{0x00, 0x01, 0x02}); err == nil {
+		t.Errorf("There should have been an error because there were bytes left after decoding")
+	}
+}
+
+func TestDecodeRemainingLengthShortBuffer(t *testing.T) {
+	if _, err := decodeRemainingLength([]byte{0x80, 0x80}); err == nil {
+		t.Errorf("There should have been an error because the buffer ended before the remaining length")
+	}
+	if _, err := decodeRemainingLength([]byte{}); err == nil {
+		t.Errorf("There should have been an error because the buffer was empty")
+	}
+	length, err := decodeRemainingLength(encodeRemainingLength(0))
+	if err != nil || length != 0 {
+		t.Errorf("A remaining length of zero was not encoded correctly: %v %v", length, err)
+	}
+}
+
+func TestUint16(t *testing.T) {
+	tests := map[uint16][]byte{
+		0:     {0x00, 0x00},
+		255:   {0x00, 0xFF},
+		256:   {0x01, 0x00},
+		65535: {0xFF, 0xFF},
+	}
+	for value, expected := range tests {
+		buf := bytes.Buffer{}
+		writeUint16(&buf, value)
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("The value %v was encoded incorrectly. Expected %v and got %v", value, expected, buf.Bytes())
+		}
+		result, err := readUint16(&buf)
+		if err != nil {
+			t.Errorf("An error occurred while decoding %v: %v", value, err)
+		}
+		if result != value {
+			t.Errorf("The result was incorrect. Test value was %v and result was %v", value, result)
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{0x01})
+	if _, err := readUint16(buf); err == nil {
+		t.Errorf("There should have been an error because only one byte was available")
+	}
+}
+
+func TestUint16Fields(t *testing.T) {
+	for _, value := range []uint16{0, 255, 256, 65535} {
+		h := PublishAckProperties{PacketID: value}
+		buf, err := h.Encode()
+		if err != nil {
+			t.Fatalf("An error occurred while encoding the packet identifier %v: %v", value, err)
+		}
+		if buf[0] != byte(value>>8) || buf[1] != byte(value) {
+			t.Errorf("The packet identifier %v was not encoded in network byte order: %v", value, buf)
+		}
+		decoded := PublishAckProperties{}
+		if err = decoded.Decode(buf); err != nil || decoded.PacketID != value {
+			t.Errorf("The packet identifier %v was decoded as %v (%v)", value, decoded.PacketID, err)
+		}
+
+		c := ConnectProperties{ProtocolName: "MQTT", ProtocolLevel: 4, KeepAlive: value}
+		buf, err = c.Encode()
+		if err != nil {
+			t.Fatalf("An error occurred while encoding the keep alive %v: %v", value, err)
+		}
+		decodedConnect := ConnectProperties{}
+		if err = decodedConnect.Decode(buf); err != nil || decodedConnect.KeepAlive != value {
+			t.Errorf("The keep alive %v was decoded as %v (%v)", value, decodedConnect.KeepAlive, err)
+		}
+	}
+
+	// String length prefixes above 255 bytes
+	topic := strings.Repeat("t", 300)
+	h := PublishProperties{QoSLevel: QoSAtLeastOnce, TopicName: topic, PacketID: 65535}
+	buf, err := h.Encode()
+	if err != nil {
+		t.Fatalf("An error occurred while encoding the long topic name: %v", err)
+	}
+	if buf[0] != 0x01 || buf[1] != 0x2C {
+		t.Errorf("The length of the topic name was not encoded in network byte order: %v", buf[:2])
+	}
+	decoded := PublishProperties{QoSLevel: QoSAtLeastOnce}
+	if err = decoded.Decode(buf); err != nil || decoded != h {
+		t.Errorf("The long topic name was decoded incorrectly (%v)", err)
+	}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	topics := []TopicSubscription{
+		{Filter: "z", QoS: QoSAtMostOnce},
+		{Filter: "a", QoS: QoSExactlyOnce},
+		{Filter: "m/#", QoS: QoSAtLeastOnce},
+		{Filter: "b/+", QoS: 0},
+	}
+	buf, err := SubscribePayload{Topics: topics}.Encode()
+	if err != nil {
+		t.Fatalf("An error occurred while encoding the SUBSCRIBE payload: %v", err)
+	}
+	expected := []byte{
+		0x00, 0x01, 'z', 0x00,
+		0x00, 0x01, 'a', 0x02,
+		0x00, 0x03, 'm', '/', '#', 0x01,
+		0x00, 0x03, 'b', '/', '+', 0x00,
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("The topics were not encoded in order. Expected %v and got %v", expected, buf)
+	}
+
+	buf, err = UnsubscribePayload{Topics: []string{"z", "a"}}.Encode()
+	if err != nil {
+		t.Fatalf("An error occurred while encoding the UNSUBSCRIBE payload: %v", err)
+	}
+	expected = []byte{0x00, 0x01, 'z', 0x00, 0x01, 'a'}
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("The UNSUBSCRIBE payload should only contain topic filters. Expected %v and got %v", expected, buf)
+	}
+}
+
+func TestSubscribeReturnCode(t *testing.T) {
+	codes := map[SubscribeReturnCode]QoSLevel{
+		SubscribeGrantedAtMostOnce:  QoSAtMostOnce,
+		SubscribeGrantedAtLeastOnce: QoSAtLeastOnce,
+		SubscribeGrantedExactlyOnce: QoSExactlyOnce,
+	}
+	for code, expected := range codes {
+		if qos, ok := code.Granted(); !ok || qos != expected {
+			t.Errorf("The return code %v should have granted %v, got %v", code, expected, qos)
+		}
+	}
+	if _, ok := SubscribeFailure.Granted(); ok {
+		t.Errorf("The failure return code should not grant a quality of service")
+	}
+}
+
+func TestV5PacketRoundTrip(t *testing.T) {
+	props := &V5Properties{ReasonString: "ok", UserProperties: []UserProperty{{"k", "v"}}}
+	connect := ConnectProperties{ProtocolName: "MQTT", ProtocolLevel: ProtocolLevel5, CleanSession: true,
+		WillFlag: true, KeepAlive: 60, Properties: &V5Properties{SessionExpiryInterval: 120}}
+	connectPayload := connect.NewPayload()
+	connectPayload.Identifier = "client1"
+	connectPayload.WillProperties = &V5Properties{WillDelayInterval: 5}
+	connectPayload.WillTopic = "will/topic"
+	connectPayload.WillMessage = []byte("bye")
+	sent := []*packet{
+		newPacketConnect(connect, connectPayload),
+		newPacketConnectAck(ConnectAckProperties{ReturnCode: int(ReasonBadUserNameOrPassword), Properties: props}),
+		newPacketPublish(PublishProperties{QoSLevel: QoSAtLeastOnce, TopicName: "a/b", PacketID: 1,
+			Properties: &V5Properties{ContentType: "text/plain"}}, []byte("hello")),
+		newPacketPublishAck(PublishAckProperties{PacketID: 1}),
+		newPacketPublishRec(PublishRecProperties{PacketID: 2, ReasonCode: ReasonNoMatchingSubscribers}),
+		newPacketPublishRel(PublishRelProperties{PacketID: 2, ReasonCode: ReasonPacketIdentifierNotFound,
+			Properties: props}),
+		newPacketPublishComp(PublishCompProperties{PacketID: 2}),
+		newPacketSubscribe(SubscribeProperties{PacketID: 3, Properties: &V5Properties{SubscriptionIdentifiers: []uint32{9}}},
+			SubscribePayload{Topics: []TopicSubscription{{Filter: "a/#", QoS: QoSExactlyOnce, NoLocal: true,
+				RetainAsPublished: true, RetainHandling: 2}}}),
+		newPacketSubscribeAck(SubscribeAckProperties{PacketID: 3},
+			SubscribeAckPayload{ReturnCodes: []SubscribeReturnCode{SubscribeGrantedExactlyOnce,
+				SubscribeReturnCode(ReasonTopicFilterInvalid)}}),
+		newPacketUnsubscribe(UnsubscribeProperties{PacketID: 4}, UnsubscribePayload{Topics: []string{"a/#"}}),
+		newPacketUnsubscribeAck(UnsubscribeAckProperties{PacketID: 4},
+			UnsubscribeAckPayload{ReasonCodes: []ReasonCode{ReasonNoSubscriptionExisted}}),
+		newPacketAuth(AuthProperties{ReasonCode: ReasonContinueAuthentication,
+			Properties: &V5Properties{AuthenticationMethod: "SCRAM", AuthenticationData: []byte{0x01}}}),
+		newPacketDisconnect(DisconnectProperties{ReasonCode: ReasonServerShuttingDown}),
+		newPacketDisconnect(DisconnectProperties{}),
+	}
+
+	stream := bytes.Buffer{}
+	writer := newPacketWriter(&stream)
+	for _, p := range sent {
+		if err := writer.writePacket(p); err != nil {
+			t.Fatalf("An error occurred while writing the %x packet: %v", p.ptype, err)
+		}
+	}
+	reader := newPacketReader(&stream, 0)
+	for _, expected := range sent {
+		p, err := reader.readPacket()
+		if err != nil {
+			t.Fatalf("An error occurred while reading the %x packet: %v", expected.ptype, err)
+		}
+		if p.level != ProtocolLevel5 {
+			t.Errorf("The %x packet should have been read as MQTT 5.0, got level %v", p.ptype, p.level)
+		}
+		if !reflect.DeepEqual(p.properties, expected.properties) {
+			t.Errorf("The variable header was read incorrectly. Expected %+v and got %+v", expected.properties,
+				p.properties)
+		}
+		if !reflect.DeepEqual(p.content, expected.content) {
+			t.Errorf("The payload was read incorrectly. Expected %+v and got %+v", expected.content, p.content)
+		}
+	}
+}
+
+func TestV5ShortForms(t *testing.T) {
+	short := map[string]*packet{
+		"PUBACK":     newPacketPublishAck(PublishAckProperties{PacketID: 1}),
+		"DISCONNECT": newPacketDisconnect(DisconnectProperties{}),
+	}
+	expected := map[string][]byte{
+		"PUBACK":     {0x40, 0x02, 0x00, 0x01},
+		"DISCONNECT": {0xE0, 0x00},
+	}
+	for name, p := range short {
+		p.level = ProtocolLevel5
+		if err := p.encode(); err != nil {
+			t.Fatalf("An error occurred while encoding the %s packet: %v", name, err)
+		}
+		if !bytes.Equal(p.buffer.Bytes(), expected[name]) {
+			t.Errorf("A successful %s without properties should be shortened. Expected %v and got %v", name,
+				expected[name], p.buffer.Bytes())
+		}
+	}
+
+	p := &packet{level: ProtocolLevel5}
+	if err := p.decode([]byte{0x40, 0x03, 0x00, 0x01, 0x10}); err != nil {
+		t.Fatalf("A PUBACK without properties should have been decoded: %v", err)
+	}
+	if h := p.properties.(PublishAckProperties); h.ReasonCode != ReasonNoMatchingSubscribers || h.Properties != nil {
+		t.Errorf("The PUBACK reason code was decoded incorrectly: %+v", h)
+	}
+}
+
+func TestV5OnlyPackets(t *testing.T) {
+	p := &packet{}
+	if err := p.decode([]byte{0xF0, 0x00}); err == nil {
+		t.Errorf("An AUTH packet should not be accepted before MQTT 5.0")
+	}
+	p = &packet{level: ProtocolLevel5}
+	if err := p.decode([]byte{0xF0, 0x00}); err != nil {
+		t.Errorf("An empty AUTH packet should be accepted for MQTT 5.0: %v", err)
+	}
+	p = &packet{}
+	if err := p.decode([]byte{0x90, 0x03, 0x00, 0x01, 0x8F}); err == nil {
+		t.Errorf("A MQTT 5.0 reason code should not be accepted in a MQTT 3.1.1 SUBACK")
+	}
+	p = &packet{}
+	if err := p.decode([]byte{0xB0, 0x03, 0x00, 0x01, 0x00}); err == nil {
+		t.Errorf("A MQTT 3.1.1 UNSUBACK should not have a payload")
+	}
+}
+
+func TestMQTT31Connect(t *testing.T) {
+	h := ConnectProperties{ProtocolLevel: ProtocolLevel31, CleanSession: true, KeepAlive: 10}
+	payload := h.NewPayload()
+	payload.Identifier = "legacy-device/01"
+	stream := bytes.Buffer{}
+	if err := newPacketWriter(&stream).writePacket(newPacketConnect(h, payload)); err != nil {
+		t.Fatalf("An error occurred while writing the MQTT 3.1 CONNECT packet: %v", err)
+	}
+	if !bytes.Contains(stream.Bytes(), []byte{0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', 0x03}) {
+		t.Errorf("The MQTT 3.1 protocol name and level were not written: %v", stream.Bytes())
+	}
+	reader := newPacketReader(&stream, 0)
+	p, err := reader.readPacket()
+	if err != nil {
+		t.Fatalf("An error occurred while reading the MQTT 3.1 CONNECT packet: %v", err)
+	}
+	if d := p.properties.(ConnectProperties); d.ProtocolName != ProtocolNameMQIsdp || d.ProtocolLevel != 3 {
+		t.Errorf("The MQTT 3.1 protocol was read incorrectly: %+v", d)
+	}
+	if c := p.content.(ConnectPayload); c.Identifier != payload.Identifier {
+		t.Errorf("The identifier was read incorrectly. Expected %v and got %v", payload.Identifier, c.Identifier)
+	}
+	if reader.level != ProtocolLevel31 {
+		t.Errorf("The reader should have adopted protocol level 3, got %v", reader.level)
+	}
+
+	payload.Identifier = strings.Repeat("x", 24)
+	if _, err = payload.Encode(); err == nil {
+		t.Errorf("A MQTT 3.1 client identifier longer than 23 characters should not be encoded")
+	}
+	payload.Identifier = ""
+	if _, err = payload.Encode(); err == nil {
+		t.Errorf("An empty MQTT 3.1 client identifier should not be encoded")
+	}
+}
+
+func TestConnectProtocolName(t *testing.T) {
+	for _, h := range []ConnectProperties{
+		{ProtocolName: ProtocolNameMQTT, ProtocolLevel: ProtocolLevel31},
+		{ProtocolName: ProtocolNameMQIsdp, ProtocolLevel: ProtocolLevel311},
+		{ProtocolLevel: 6},
+	} {
+		if _, err := h.Encode(); err == nil {
+			t.Errorf("The protocol name %q with level %v should not be encoded", h.ProtocolName, h.ProtocolLevel)
+		}
+	}
+	decoded := ConnectProperties{}
+	if err := decoded.Decode([]byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x03, 0x02, 0x00, 0x00}); err == nil {
+		t.Errorf("The protocol name MQTT should not be accepted with protocol level 3")
+	}
+}
+
+func TestConnectEmptyIdentifier(t *testing.T) {
+	h := ConnectProperties{ProtocolLevel: ProtocolLevel311, CleanSession: true}
+	payload := h.NewPayload()
+	if _, err := payload.Encode(); err != nil {
+		t.Errorf("An empty client identifier should be allowed with a clean session: %v", err)
+	}
+	h.CleanSession = false
+	payload = h.NewPayload()
+	if _, err := payload.Encode(); err == nil {
+		t.Errorf("An empty client identifier should not be allowed without a clean session")
+	}
+	h.ProtocolLevel = ProtocolLevel5
+	payload = h.NewPayload()
+	if _, err := payload.Encode(); err != nil {
+		t.Errorf("An empty client identifier should always be allowed for MQTT 5.0: %v", err)
+	}
+}
+
+func TestConnectWill(t *testing.T) {
+	h := ConnectProperties{ProtocolLevel: ProtocolLevel311, WillFlag: true, WillQoS: QoSExactlyOnce, WillRetain: true}
+	buf, err := h.Encode()
+	if err != nil {
+		t.Fatalf("An error occurred while encoding the header: %v", err)
+	}
+	if buf[7] != 0x34 {
+		t.Errorf("The will flags were encoded incorrectly. Expected 0x34 and got %#x", buf[7])
+	}
+	decoded := ConnectProperties{}
+	if err = decoded.Decode(buf); err != nil || decoded.WillQoS != QoSExactlyOnce || !decoded.WillRetain {
+		t.Errorf("The will flags were decoded incorrectly: %+v, %v", decoded, err)
+	}
+
+	for _, invalid := range []ConnectProperties{
+		{ProtocolLevel: ProtocolLevel311, WillQoS: QoSAtLeastOnce},
+		{ProtocolLevel: ProtocolLevel311, WillRetain: true},
+		{ProtocolLevel: ProtocolLevel311, WillFlag: true, WillQoS: 0x06},
+	} {
+		if _, err = invalid.Encode(); err == nil {
+			t.Errorf("The will flags of %+v should not be encoded", invalid)
+		}
+	}
+
+	payload := h.NewPayload()
+	payload.Identifier = "client1"
+	if _, err = payload.Encode(); err == nil {
+		t.Errorf("A will flag without a will topic should not be encoded")
+	}
+	payload.WillTopic = "status/#"
+	if _, err = payload.Encode(); err == nil {
+		t.Errorf("A will topic with a wildcard should not be encoded")
+	}
+	payload.WillTopic = "status"
+	if buf, err = payload.Encode(); err != nil {
+		t.Errorf("A will without a message should be encoded with an empty message: %v", err)
+	} else if !bytes.HasSuffix(buf, []byte{0x00, 0x00}) {
+		t.Errorf("The empty will message was encoded incorrectly: %v", buf)
+	}
+	payload = ConnectProperties{ProtocolLevel: ProtocolLevel311}.NewPayload()
+	payload.Identifier = "client1"
+	payload.WillTopic = "status"
+	if _, err = payload.Encode(); err == nil {
+		t.Errorf("A will topic should not be encoded without the will flag")
+	}
+}
+
+func TestConnectCredentials(t *testing.T) {
+	h := ConnectProperties{ProtocolLevel: ProtocolLevel311, CleanSession: true, Password: true}
+	if _, err := h.Encode(); err == nil {
+		t.Errorf("A password flag without a user name flag should not be encoded before MQTT 5.0")
+	}
+	h.ProtocolLevel = ProtocolLevel5
+	if _, err := h.Encode(); err != nil {
+		t.Errorf("A password flag without a user name flag should be encoded for MQTT 5.0: %v", err)
+	}
+
+	payload := ConnectProperties{ProtocolLevel: ProtocolLevel311, CleanSession: true}.NewPayload()
+	payload.UserName = "user"
+	if _, err := payload.Encode(); err == nil {
+		t.Errorf("A user name should not be encoded without the user name flag")
+	}
+	payload.UserName = ""
+	payload.Password = []byte("secret")
+	if _, err := payload.Encode(); err == nil {
+		t.Errorf("A password should not be encoded without the password flag")
+	}
+	payload = ConnectProperties{ProtocolLevel: ProtocolLevel311, CleanSession: true, UserName: true}.NewPayload()
+	buf, err := payload.Encode()
+	if err != nil {
+		t.Fatalf("An empty user name should be encoded when the flag is set: %v", err)
+	}
+	if expected := []byte{0x00, 0x00, 0x00, 0x00}; !bytes.Equal(buf, expected) {
+		t.Errorf("The empty user name was encoded incorrectly. Expected %v and got %v", expected, buf)
+	}
+}
+
+func TestMQTT31ConnectAck(t *testing.T) {
+	p := &packet{level: ProtocolLevel31}
+	if err := p.decode([]byte{0x20, 0x02, 0x01, 0x00}); err != nil {
+		t.Fatalf("The unused MQTT 3.1 acknowledge flags should be ignored: %v", err)
+	}
+	if h := p.properties.(ConnectAckProperties); h.SessionPresent {
+		t.Errorf("MQTT 3.1 has no session present flag")
+	}
+}
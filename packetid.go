@@ -0,0 +1,90 @@
+package wavemq
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrPacketIDsExhausted is returned when a packet needs an identifier but all 65535 of them are waiting for their
+// acknowledgement.
+var ErrPacketIDsExhausted = errors.New("No packet identifier is available")
+
+// packetIDs hands out the packet identifiers of the PUBLISH, SUBSCRIBE and UNSUBSCRIBE packets a client sends. An
+// identifier is in use from the moment it is handed out until it is released, once the flow it was used for has
+// completed, so that no two packets that wait for an acknowledgement have the same identifier. Identifiers are handed
+// out in increasing order, wrapping around after 65535, so that an identifier is not reused right after its release.
+// It is safe to use from multiple goroutines.
+//
+// REQ: MQTT-2.3.1-1, MQTT-2.3.1-2
+type packetIDs struct {
+	lock  sync.Mutex
+	last  uint16
+	used  map[uint16]bool
+	freed chan struct{}
+}
+
+// newPacketIDs creates an allocator with the provided identifiers already in use, which are those of the packets that
+// are in flight in a resumed session.
+func newPacketIDs(used ...uint16) *packetIDs {
+	a := &packetIDs{used: map[uint16]bool{}, freed: make(chan struct{})}
+	for _, id := range used {
+		if id != 0 {
+			a.used[id] = true
+		}
+	}
+	return a
+}
+
+// allocate returns an identifier that is not in use and marks it as used. It fails with ErrPacketIDsExhausted when
+// every identifier is in use.
+func (a *packetIDs) allocate() (uint16, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.next()
+}
+
+// acquire does the same as allocate, except that it waits for an identifier to be released when every identifier is
+// in use. It gives up with ErrPacketIDsExhausted once the done channel is closed. A nil channel does not wait at all.
+func (a *packetIDs) acquire(done <-chan struct{}) (uint16, error) {
+	for {
+		a.lock.Lock()
+		id, err := a.next()
+		freed := a.freed
+		a.lock.Unlock()
+		if err == nil || done == nil {
+			return id, err
+		}
+		select {
+		case <-freed:
+		case <-done:
+			return 0, ErrPacketIDsExhausted
+		}
+	}
+}
+
+// next finds the identifier after the last one that was handed out that is not in use. The allocator must be locked.
+func (a *packetIDs) next() (uint16, error) {
+	if len(a.used) >= 0xFFFF {
+		return 0, ErrPacketIDsExhausted
+	}
+	for {
+		a.last++
+		if a.last != 0 && !a.used[a.last] {
+			a.used[a.last] = true
+			return a.last, nil
+		}
+	}
+}
+
+// release makes the identifier available again and wakes up the callers of acquire that are waiting for one.
+// Releasing an identifier that is not in use does nothing.
+func (a *packetIDs) release(id uint16) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.used[id] {
+		return
+	}
+	delete(a.used, id)
+	close(a.freed)
+	a.freed = make(chan struct{})
+}
@@ -0,0 +1,62 @@
+package wavemq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacketIDsAllocate(t *testing.T) {
+	a := newPacketIDs(2)
+	for _, expected := range []uint16{1, 3, 4} {
+		if id, err := a.allocate(); err != nil || id != expected {
+			t.Errorf("Expected packet identifier %v and got %v (%v)", expected, id, err)
+		}
+	}
+	a.release(1)
+	if id, _ := a.allocate(); id != 5 {
+		t.Errorf("A released identifier should not be reused right away, got %v", id)
+	}
+
+	a.last = 0xFFFE
+	a.release(2)
+	if id, _ := a.allocate(); id != 0xFFFF {
+		t.Errorf("Expected packet identifier 65535 and got %v", id)
+	}
+	if id, _ := a.allocate(); id != 1 {
+		t.Errorf("The identifiers should wrap around without ever handing out zero, got %v", id)
+	}
+	if id, _ := a.allocate(); id != 2 {
+		t.Errorf("Expected the released packet identifier 2 and got %v", id)
+	}
+}
+
+func TestPacketIDsExhausted(t *testing.T) {
+	a := newPacketIDs()
+	for i := 0; i < 0xFFFF; i++ {
+		if _, err := a.allocate(); err != nil {
+			t.Fatalf("An error occurred while allocating identifier %v: %v", i+1, err)
+		}
+	}
+	if _, err := a.allocate(); err != ErrPacketIDsExhausted {
+		t.Errorf("Allocating more than 65535 identifiers should have failed, got %v", err)
+	}
+	if _, err := a.acquire(nil); err != ErrPacketIDsExhausted {
+		t.Errorf("Acquiring without a done channel should not wait, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		a.release(42)
+	}()
+	if id, err := a.acquire(done); err != nil || id != 42 {
+		t.Errorf("Acquiring should have waited for identifier 42 to be released, got %v (%v)", id, err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(done)
+	}()
+	if _, err := a.acquire(done); err != ErrPacketIDsExhausted {
+		t.Errorf("Acquiring should have given up once the done channel was closed, got %v", err)
+	}
+}
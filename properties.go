@@ -0,0 +1,447 @@
+package wavemq
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Constants
+
+// ReasonCode is a single byte that MQTT 5.0 uses to report the result of an operation in CONNACK, PUBACK, PUBREC,
+// PUBREL, PUBCOMP, SUBACK, UNSUBACK, DISCONNECT and AUTH packets. Values below 0x80 indicate success, values of 0x80
+// and above indicate failure.
+type ReasonCode byte
+
+// The following constants define the reason codes of the MQTT 5.0 specification. Some values have more than one
+// meaning depending on the packet they are sent in, in which case they are given one name per meaning.
+const (
+	ReasonSuccess                             ReasonCode = 0x00
+	ReasonNormalDisconnection                 ReasonCode = 0x00
+	ReasonGrantedQoS0                         ReasonCode = 0x00
+	ReasonGrantedQoS1                         ReasonCode = 0x01
+	ReasonGrantedQoS2                         ReasonCode = 0x02
+	ReasonDisconnectWithWillMessage           ReasonCode = 0x04
+	ReasonNoMatchingSubscribers               ReasonCode = 0x10
+	ReasonNoSubscriptionExisted               ReasonCode = 0x11
+	ReasonContinueAuthentication              ReasonCode = 0x18
+	ReasonReAuthenticate                      ReasonCode = 0x19
+	ReasonUnspecifiedError                    ReasonCode = 0x80
+	ReasonMalformedPacket                     ReasonCode = 0x81
+	ReasonProtocolError                       ReasonCode = 0x82
+	ReasonImplementationSpecificError         ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion          ReasonCode = 0x84
+	ReasonClientIdentifierNotValid            ReasonCode = 0x85
+	ReasonBadUserNameOrPassword               ReasonCode = 0x86
+	ReasonNotAuthorized                       ReasonCode = 0x87
+	ReasonServerUnavailable                   ReasonCode = 0x88
+	ReasonServerBusy                          ReasonCode = 0x89
+	ReasonBanned                              ReasonCode = 0x8A
+	ReasonServerShuttingDown                  ReasonCode = 0x8B
+	ReasonBadAuthenticationMethod             ReasonCode = 0x8C
+	ReasonKeepAliveTimeout                    ReasonCode = 0x8D
+	ReasonSessionTakenOver                    ReasonCode = 0x8E
+	ReasonTopicFilterInvalid                  ReasonCode = 0x8F
+	ReasonTopicNameInvalid                    ReasonCode = 0x90
+	ReasonPacketIdentifierInUse               ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound            ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded              ReasonCode = 0x93
+	ReasonTopicAliasInvalid                   ReasonCode = 0x94
+	ReasonPacketTooLarge                      ReasonCode = 0x95
+	ReasonMessageRateTooHigh                  ReasonCode = 0x96
+	ReasonQuotaExceeded                       ReasonCode = 0x97
+	ReasonAdministrativeAction                ReasonCode = 0x98
+	ReasonPayloadFormatInvalid                ReasonCode = 0x99
+	ReasonRetainNotSupported                  ReasonCode = 0x9A
+	ReasonQoSNotSupported                     ReasonCode = 0x9B
+	ReasonUseAnotherServer                    ReasonCode = 0x9C
+	ReasonServerMoved                         ReasonCode = 0x9D
+	ReasonSharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ReasonConnectionRateExceeded              ReasonCode = 0x9F
+	ReasonMaximumConnectTime                  ReasonCode = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+// Failed returns true if the reason code reports a failure.
+func (r ReasonCode) Failed() bool {
+	return r >= ReasonUnspecifiedError
+}
+
+// The following constants are the identifiers of the properties that can be sent in the property block of a MQTT 5.0
+// packet. Each identifier decides the type of the value that follows it.
+const (
+	propPayloadFormatIndicator          byte = 0x01
+	propMessageExpiryInterval           byte = 0x02
+	propContentType                     byte = 0x03
+	propResponseTopic                   byte = 0x08
+	propCorrelationData                 byte = 0x09
+	propSubscriptionIdentifier          byte = 0x0B
+	propSessionExpiryInterval           byte = 0x11
+	propAssignedClientIdentifier        byte = 0x12
+	propServerKeepAlive                 byte = 0x13
+	propAuthenticationMethod            byte = 0x15
+	propAuthenticationData              byte = 0x16
+	propRequestProblemInformation       byte = 0x17
+	propWillDelayInterval               byte = 0x18
+	propRequestResponseInformation      byte = 0x19
+	propResponseInformation             byte = 0x1A
+	propServerReference                 byte = 0x1C
+	propReasonString                    byte = 0x1F
+	propReceiveMaximum                  byte = 0x21
+	propTopicAliasMaximum               byte = 0x22
+	propTopicAlias                      byte = 0x23
+	propMaximumQoS                      byte = 0x24
+	propRetainAvailable                 byte = 0x25
+	propUserProperty                    byte = 0x26
+	propMaximumPacketSize               byte = 0x27
+	propWildcardSubscriptionAvailable   byte = 0x28
+	propSubscriptionIdentifierAvailable byte = 0x29
+	propSharedSubscriptionAvailable     byte = 0x2A
+)
+
+// ---------------------------------------------------------------------------------------------------------------------
+// Property Block
+
+// UserProperty is a name/value pair of UTF-8 strings that the application can attach to most MQTT 5.0 packets. The
+// same name is allowed to appear more than once, and the order of the pairs is kept.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// V5Properties summarizes the property block that MQTT 5.0 adds to the variable header of most control packets (and
+// to the will in the CONNECT payload). It is encoded as a variable byte integer length followed by identifier/value
+// pairs. Numeric fields that are zero and string or binary fields that are empty are not sent, since their absence
+// means the same thing. The properties where zero is a meaningful value that differs from the default are pointers
+// and are only sent when they are not nil.
+type V5Properties struct {
+	PayloadFormatIndicator           byte
+	MessageExpiryInterval            uint32
+	ContentType                      string
+	ResponseTopic                    string
+	CorrelationData                  []byte
+	SubscriptionIdentifiers          []uint32
+	SessionExpiryInterval            uint32
+	AssignedClientIdentifier         string
+	ServerKeepAlive                  *uint16
+	AuthenticationMethod             string
+	AuthenticationData               []byte
+	RequestProblemInformation        *byte
+	WillDelayInterval                uint32
+	RequestResponseInformation       byte
+	ResponseInformation              string
+	ServerReference                  string
+	ReasonString                     string
+	ReceiveMaximum                   uint16
+	TopicAliasMaximum                uint16
+	TopicAlias                       uint16
+	MaximumQoS                       *byte
+	RetainAvailable                  *byte
+	UserProperties                   []UserProperty
+	MaximumPacketSize                uint32
+	WildcardSubscriptionAvailable    *byte
+	SubscriptionIdentifiersAvailable *byte
+	SharedSubscriptionAvailable      *byte
+}
+
+// Encode writes the property block, including its variable byte integer length, to a byte slice. This is an
+// implementation of the Encodeable interface.
+func (v V5Properties) Encode() ([]byte, error) {
+	props := bytes.Buffer{}
+	writeByteProperty(&props, propPayloadFormatIndicator, v.PayloadFormatIndicator)
+	writeUint32Property(&props, propMessageExpiryInterval, v.MessageExpiryInterval)
+	if err := writeStringProperty(&props, propContentType, v.ContentType); err != nil {
+		return nil, err
+	}
+	if err := writeStringProperty(&props, propResponseTopic, v.ResponseTopic); err != nil {
+		return nil, err
+	}
+	if err := writeBinaryProperty(&props, propCorrelationData, v.CorrelationData); err != nil {
+		return nil, err
+	}
+	for _, id := range v.SubscriptionIdentifiers {
+		if id == 0 || id > MaxRemainingLength {
+			return nil, errors.New("Subscription identifiers must be between 1 and 268435455")
+		}
+		props.WriteByte(propSubscriptionIdentifier)
+		props.Write(encodeRemainingLength(id))
+	}
+	writeUint32Property(&props, propSessionExpiryInterval, v.SessionExpiryInterval)
+	if err := writeStringProperty(&props, propAssignedClientIdentifier, v.AssignedClientIdentifier); err != nil {
+		return nil, err
+	}
+	if v.ServerKeepAlive != nil {
+		props.WriteByte(propServerKeepAlive)
+		writeUint16(&props, *v.ServerKeepAlive)
+	}
+	if err := writeStringProperty(&props, propAuthenticationMethod, v.AuthenticationMethod); err != nil {
+		return nil, err
+	}
+	if err := writeBinaryProperty(&props, propAuthenticationData, v.AuthenticationData); err != nil {
+		return nil, err
+	}
+	writeOptionalByteProperty(&props, propRequestProblemInformation, v.RequestProblemInformation)
+	writeUint32Property(&props, propWillDelayInterval, v.WillDelayInterval)
+	writeByteProperty(&props, propRequestResponseInformation, v.RequestResponseInformation)
+	if err := writeStringProperty(&props, propResponseInformation, v.ResponseInformation); err != nil {
+		return nil, err
+	}
+	if err := writeStringProperty(&props, propServerReference, v.ServerReference); err != nil {
+		return nil, err
+	}
+	if err := writeStringProperty(&props, propReasonString, v.ReasonString); err != nil {
+		return nil, err
+	}
+	writeUint16Property(&props, propReceiveMaximum, v.ReceiveMaximum)
+	writeUint16Property(&props, propTopicAliasMaximum, v.TopicAliasMaximum)
+	writeUint16Property(&props, propTopicAlias, v.TopicAlias)
+	writeOptionalByteProperty(&props, propMaximumQoS, v.MaximumQoS)
+	writeOptionalByteProperty(&props, propRetainAvailable, v.RetainAvailable)
+	for _, p := range v.UserProperties {
+		props.WriteByte(propUserProperty)
+		if err := writeIfValidUtf8(&props, p.Key, true); err != nil {
+			return nil, err
+		}
+		if err := writeIfValidUtf8(&props, p.Value, true); err != nil {
+			return nil, err
+		}
+	}
+	writeUint32Property(&props, propMaximumPacketSize, v.MaximumPacketSize)
+	writeOptionalByteProperty(&props, propWildcardSubscriptionAvailable, v.WildcardSubscriptionAvailable)
+	writeOptionalByteProperty(&props, propSubscriptionIdentifierAvailable, v.SubscriptionIdentifiersAvailable)
+	writeOptionalByteProperty(&props, propSharedSubscriptionAvailable, v.SharedSubscriptionAvailable)
+
+	if uint32(props.Len()) > MaxRemainingLength {
+		return nil, errors.New("Property block is too long")
+	}
+	buf := encodeRemainingLength(uint32(props.Len()))
+	return append(buf, props.Bytes()...), nil
+}
+
+// decode reads a property block, including its variable byte integer length, from the buffer. Every property except
+// the user property and the subscription identifier may only appear once.
+func (v *V5Properties) decode(buf *bytes.Buffer) error {
+	length, err := readRemainingLength(buf)
+	if err != nil {
+		return errors.New("Malformed property block: invalid property length")
+	}
+	if uint32(buf.Len()) < length {
+		return errors.New("Malformed property block: property length is longer than the remaining bytes")
+	}
+	props := bytes.NewBuffer(buf.Next(int(length)))
+	seen := make(map[byte]bool)
+	*v = V5Properties{}
+	for props.Len() > 0 {
+		id, _ := props.ReadByte()
+		if seen[id] && id != propUserProperty && id != propSubscriptionIdentifier {
+			return errors.New("Malformed property block: property included more than once")
+		}
+		seen[id] = true
+		switch id {
+		case propPayloadFormatIndicator:
+			v.PayloadFormatIndicator, err = readByteProperty(props)
+		case propMessageExpiryInterval:
+			v.MessageExpiryInterval, err = readUint32(props)
+		case propContentType:
+			v.ContentType, err = readString(props)
+		case propResponseTopic:
+			v.ResponseTopic, err = readString(props)
+		case propCorrelationData:
+			v.CorrelationData, err = readBinary(props)
+		case propSubscriptionIdentifier:
+			var sid uint32
+			if sid, err = readRemainingLength(props); err == nil {
+				if sid == 0 {
+					return errors.New("Malformed property block: subscription identifier of zero")
+				}
+				v.SubscriptionIdentifiers = append(v.SubscriptionIdentifiers, sid)
+			}
+		case propSessionExpiryInterval:
+			v.SessionExpiryInterval, err = readUint32(props)
+		case propAssignedClientIdentifier:
+			v.AssignedClientIdentifier, err = readString(props)
+		case propServerKeepAlive:
+			var keepAlive uint16
+			keepAlive, err = readUint16(props)
+			v.ServerKeepAlive = &keepAlive
+		case propAuthenticationMethod:
+			v.AuthenticationMethod, err = readString(props)
+		case propAuthenticationData:
+			v.AuthenticationData, err = readBinary(props)
+		case propRequestProblemInformation:
+			v.RequestProblemInformation, err = readOptionalByteProperty(props)
+		case propWillDelayInterval:
+			v.WillDelayInterval, err = readUint32(props)
+		case propRequestResponseInformation:
+			v.RequestResponseInformation, err = readByteProperty(props)
+		case propResponseInformation:
+			v.ResponseInformation, err = readString(props)
+		case propServerReference:
+			v.ServerReference, err = readString(props)
+		case propReasonString:
+			v.ReasonString, err = readString(props)
+		case propReceiveMaximum:
+			v.ReceiveMaximum, err = readUint16(props)
+		case propTopicAliasMaximum:
+			v.TopicAliasMaximum, err = readUint16(props)
+		case propTopicAlias:
+			v.TopicAlias, err = readUint16(props)
+		case propMaximumQoS:
+			v.MaximumQoS, err = readOptionalByteProperty(props)
+		case propRetainAvailable:
+			v.RetainAvailable, err = readOptionalByteProperty(props)
+		case propUserProperty:
+			p := UserProperty{}
+			if p.Key, err = readString(props); err == nil {
+				p.Value, err = readString(props)
+			}
+			v.UserProperties = append(v.UserProperties, p)
+		case propMaximumPacketSize:
+			v.MaximumPacketSize, err = readUint32(props)
+		case propWildcardSubscriptionAvailable:
+			v.WildcardSubscriptionAvailable, err = readOptionalByteProperty(props)
+		case propSubscriptionIdentifierAvailable:
+			v.SubscriptionIdentifiersAvailable, err = readOptionalByteProperty(props)
+		case propSharedSubscriptionAvailable:
+			v.SharedSubscriptionAvailable, err = readOptionalByteProperty(props)
+		default:
+			return errors.New("Malformed property block: unknown property identifier")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode reads a property block, including its variable byte integer length, from the byte slice into the
+// V5Properties struct. This is an implementation of the Decodeable interface.
+func (v *V5Properties) Decode(b []byte) error {
+	return decodeAll(b, ProtocolLevel5, func(buf *bytes.Buffer, _ byte) error { return v.decode(buf) })
+}
+
+// writeProperties writes the property block to the buffer when the protocol level has one. A nil property block is
+// written as an empty one.
+func writeProperties(buf *bytes.Buffer, v *V5Properties, level byte) error {
+	if level < ProtocolLevel5 {
+		return nil
+	}
+	if v == nil {
+		buf.WriteByte(0x00)
+		return nil
+	}
+	props, err := v.Encode()
+	if err != nil {
+		return err
+	}
+	buf.Write(props)
+	return nil
+}
+
+// readProperties reads a property block from the buffer when the protocol level has one. It returns nil for lower
+// protocol levels and for empty property blocks.
+func readProperties(buf *bytes.Buffer, level byte) (*V5Properties, error) {
+	if level < ProtocolLevel5 {
+		return nil, nil
+	}
+	v := &V5Properties{}
+	if err := v.decode(buf); err != nil {
+		return nil, err
+	}
+	if v.empty() {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// empty returns true if encoding the property block would not write any properties.
+func (v *V5Properties) empty() bool {
+	props, err := v.Encode()
+	return err == nil && len(props) == 1
+}
+
+// writeByteProperty writes a single byte property if it is not zero.
+func writeByteProperty(buf *bytes.Buffer, id byte, value byte) {
+	if value != 0 {
+		buf.WriteByte(id)
+		buf.WriteByte(value)
+	}
+}
+
+// writeOptionalByteProperty writes a single byte property if it is set.
+func writeOptionalByteProperty(buf *bytes.Buffer, id byte, value *byte) {
+	if value != nil {
+		buf.WriteByte(id)
+		buf.WriteByte(*value)
+	}
+}
+
+// writeUint16Property writes a two byte integer property if it is not zero.
+func writeUint16Property(buf *bytes.Buffer, id byte, value uint16) {
+	if value != 0 {
+		buf.WriteByte(id)
+		writeUint16(buf, value)
+	}
+}
+
+// writeUint32Property writes a four byte integer property if it is not zero.
+func writeUint32Property(buf *bytes.Buffer, id byte, value uint32) {
+	if value != 0 {
+		buf.WriteByte(id)
+		writeUint32(buf, value)
+	}
+}
+
+// writeStringProperty writes a UTF-8 encoded string property if it is not empty.
+func writeStringProperty(buf *bytes.Buffer, id byte, value string) error {
+	if len(value) == 0 {
+		return nil
+	}
+	buf.WriteByte(id)
+	return writeIfValidUtf8(buf, value, true)
+}
+
+// writeBinaryProperty writes a binary data property if it is not empty.
+func writeBinaryProperty(buf *bytes.Buffer, id byte, value []byte) error {
+	if len(value) == 0 {
+		return nil
+	}
+	buf.WriteByte(id)
+	return writeInterface(buf, value)
+}
+
+// readByteProperty reads the value of a single byte property.
+func readByteProperty(buf *bytes.Buffer) (byte, error) {
+	value, err := buf.ReadByte()
+	if err != nil {
+		return 0, errors.New("Malformed property block: missing property value")
+	}
+	return value, nil
+}
+
+// readOptionalByteProperty reads the value of a single byte property whose zero value is meaningful.
+func readOptionalByteProperty(buf *bytes.Buffer) (*byte, error) {
+	value, err := readByteProperty(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// writeUint32 writes a four byte integer to the buffer in big-endian (network) byte order.
+func writeUint32(buf *bytes.Buffer, value uint32) {
+	buf.WriteByte(byte(value >> 24))
+	buf.WriteByte(byte(value >> 16))
+	buf.WriteByte(byte(value >> 8))
+	buf.WriteByte(byte(value))
+}
+
+// readUint32 reads a four byte integer in big-endian (network) byte order from the buffer.
+func readUint32(buf *bytes.Buffer) (uint32, error) {
+	b := buf.Next(4)
+	if len(b) != 4 {
+		return 0, errors.New("Malformed packet: not enough bytes for a four byte integer")
+	}
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), nil
+}
@@ -0,0 +1,65 @@
+package wavemq
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestV5PropertiesRoundTrip(t *testing.T) {
+	keepAlive := uint16(30)
+	zero := byte(0)
+	props := V5Properties{
+		PayloadFormatIndicator:  1,
+		MessageExpiryInterval:   3600,
+		ContentType:             "application/json",
+		ResponseTopic:           "a/response",
+		CorrelationData:         []byte{0x01, 0x02},
+		SubscriptionIdentifiers: []uint32{1, 268435455},
+		ServerKeepAlive:         &keepAlive,
+		RetainAvailable:         &zero,
+		TopicAlias:              7,
+		UserProperties:          []UserProperty{{"a", "1"}, {"a", "2"}, {"b", ""}},
+	}
+	buf, err := props.Encode()
+	if err != nil {
+		t.Fatalf("An error occurred while encoding the properties: %v", err)
+	}
+	decoded := V5Properties{}
+	if err = decoded.Decode(buf); err != nil {
+		t.Fatalf("An error occurred while decoding the properties: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, props) {
+		t.Errorf("The properties were decoded incorrectly. Expected %+v and got %+v", props, decoded)
+	}
+}
+
+func TestV5PropertiesMalformed(t *testing.T) {
+	malformed := map[string][]byte{
+		"duplicate property":    {0x04, 0x23, 0x00, 0x01, 0x23},
+		"unknown property":      {0x02, 0x7F, 0x00},
+		"length past the end":   {0x05, 0x01, 0x01},
+		"zero subscription ID":  {0x02, 0x0B, 0x00},
+		"truncated user string": {0x04, 0x26, 0x00, 0x05, 0x61},
+	}
+	for name, b := range malformed {
+		props := V5Properties{}
+		if err := props.Decode(b); err == nil {
+			t.Errorf("Decoding a property block with a %s should have failed", name)
+		}
+	}
+}
+
+func TestWriteProperties(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := writeProperties(&buf, &V5Properties{TopicAlias: 1}, ProtocolLevel311); err != nil || buf.Len() != 0 {
+		t.Errorf("No properties should be written before MQTT 5.0, got %v", buf.Bytes())
+	}
+	if err := writeProperties(&buf, nil, ProtocolLevel5); err != nil || !bytes.Equal(buf.Bytes(), []byte{0x00}) {
+		t.Errorf("Missing properties should be written as an empty block, got %v", buf.Bytes())
+	}
+	props, err := readProperties(&buf, ProtocolLevel5)
+	if err != nil || props != nil {
+		t.Errorf("An empty block should be read as missing properties, got %v and %v", props, err)
+	}
+}
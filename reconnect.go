@@ -0,0 +1,120 @@
+package wavemq
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff configures how long a client waits before each attempt to reconnect. The first attempt waits Initial, and
+// every failed attempt multiplies the wait by Multiplier, up to Max. A random jitter of up to the Jitter fraction of
+// the wait is added or subtracted, so that clients which lost their connection at the same time do not all reconnect
+// at the same time. The zero value stands for DefaultBackoff.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// DefaultBackoff is the backoff used by clients that do not configure one. It starts at one second and doubles up to
+// two minutes, with 20% jitter.
+var DefaultBackoff = Backoff{Initial: time.Second, Max: 2 * time.Minute, Multiplier: 2, Jitter: 0.2}
+
+// delay returns how long to wait before the numbered attempt, counting from one. A Multiplier below one is treated as
+// one, and a zero Max means the wait is not limited.
+func (b Backoff) delay(attempt int) time.Duration {
+	if b == (Backoff{}) {
+		b = DefaultBackoff
+	}
+	wait := float64(b.Initial)
+	for i := 1; i < attempt && (b.Max == 0 || wait < float64(b.Max)); i++ {
+		if b.Multiplier > 1 {
+			wait *= b.Multiplier
+		}
+	}
+	if b.Max > 0 && wait > float64(b.Max) {
+		wait = float64(b.Max)
+	}
+	wait += wait * b.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(wait)
+}
+
+// reconnect tries to re-establish the connection of the client until it succeeds, the server refuses the connection
+// permanently or the stop channel is closed by Client.Close. It waits between attempts as configured by the backoff of
+// the client.
+func (c *Client) reconnect(stop chan struct{}) {
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(c.Backoff.delay(attempt))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if c.OnReconnecting != nil {
+			c.OnReconnecting(attempt)
+		}
+
+		c.lock.Lock()
+		session, will, credentials := c.Sessions[c.session], c.will, c.Credentials
+		c.lock.Unlock()
+		conn, ack, _, err := c.open(session.ServerAddress, session.ConnectionProperties, session.identifier, will,
+			credentials)
+		if err != nil {
+			c.reconnectError(attempt, err)
+			if permanentRefusal(err) {
+				c.giveUp(stop)
+				return
+			}
+			continue
+		}
+
+		c.lock.Lock()
+		if c.stop != stop {
+			c.lock.Unlock()
+			conn.close()
+			return
+		}
+		c.attach(conn, ack)
+		err = c.saveSession()
+		c.lock.Unlock()
+		if err != nil {
+			c.reconnectError(attempt, err)
+		}
+		if c.OnReconnect != nil {
+			c.OnReconnect()
+		}
+		return
+	}
+}
+
+// reconnectError passes the error of an attempt to reconnect to OnReconnectError.
+func (c *Client) reconnectError(attempt int, err error) {
+	if c.OnReconnectError != nil {
+		c.OnReconnectError(attempt, err)
+	}
+}
+
+// permanentRefusal reports whether the error is a refusal of the server that the client would get again on every
+// attempt to reconnect with the same properties and credentials.
+func permanentRefusal(err error) bool {
+	switch err {
+	case ErrUnacceptableProtocolVersion, ErrIdentifierRejected, ErrBadUserNameOrPassword, ErrNotAuthorized:
+		return true
+	}
+	return false
+}
+
+// giveUp stops reconnecting and closes the client, unless Client.Close already did. The deliveries that were waiting
+// for the connection end with ErrDeliveryInterrupted and the queued packets are dropped.
+func (c *Client) giveUp(stop chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stop != stop {
+		return
+	}
+	close(c.stop)
+	c.stop = nil
+	c.queue = nil
+	c.interruptDeliveries()
+}
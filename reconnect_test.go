@@ -0,0 +1,237 @@
+package wavemq
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range expected {
+		if d := b.delay(i + 1); d != e*time.Millisecond {
+			t.Errorf("Attempt %v should wait %v, got %v", i+1, e*time.Millisecond, d)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.delay(2); d < 10*time.Millisecond || d > 30*time.Millisecond {
+			t.Errorf("The jitter should keep the wait within 50%% of 20ms, got %v", d)
+		}
+	}
+	if d := (Backoff{}).delay(1); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+		t.Errorf("The zero backoff should use the default, got %v", d)
+	}
+}
+
+func TestClientAutoReconnect(t *testing.T) {
+	subscribed := make(chan []TopicSubscription, 2)
+	published := make(chan string, 1)
+	subscribes := 0
+	address := (&testServer{Connections: 2, Answer: func(conn *connection, p *packet) {
+		switch p.ptype {
+		case ptypeSubscribe:
+			subscribed <- p.content.(SubscribePayload).Topics
+			// Drop the first connection to make the client reconnect
+			if subscribes++; subscribes == 1 {
+				conn.close()
+			}
+		case ptypePublish:
+			published <- p.properties.(PublishProperties).TopicName
+		}
+	}}).start(t)
+
+	var lock sync.Mutex
+	var events []string
+	reconnected := make(chan struct{})
+	client := Client{Name: "client1", AutoReconnect: true, Backoff: Backoff{Initial: 10 * time.Millisecond}}
+	client.OnConnectionLost = func(err error) {
+		lock.Lock()
+		events = append(events, "lost")
+		lock.Unlock()
+		// Publishing while the client is reconnecting queues the message
+		if err := client.send(newPacketPublish(PublishProperties{TopicName: "queued"}, []byte{0x01})); err != nil {
+			t.Errorf("The PUBLISH should have been queued: %v", err)
+		}
+	}
+	client.OnReconnecting = func(attempt int) {
+		lock.Lock()
+		events = append(events, "reconnecting")
+		lock.Unlock()
+	}
+	client.OnReconnect = func() {
+		lock.Lock()
+		events = append(events, "reconnected")
+		lock.Unlock()
+		close(reconnected)
+	}
+	topic := Topic{Name: "a/b", Message: []byte{}, QoS: QoSAtLeastOnce}
+	if _, err := client.SubscribeTo(topic, SubscriberOptions{}); err != nil {
+		t.Fatalf("Subscribing before connecting should not fail: %v", err)
+	}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+
+	for n := 0; n < 2; n++ {
+		select {
+		case topics := <-subscribed:
+			if len(topics) != 1 || topics[0].Filter != "a/b" || topics[0].QoS != QoSAtLeastOnce {
+				t.Errorf("The client should have subscribed to a/b, got %v", topics)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("The client should have subscribed on connection %v", n+1)
+		}
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The client should have reported the reconnect")
+	}
+	select {
+	case topic := <-published:
+		if topic != "queued" {
+			t.Errorf("The queued PUBLISH should have been sent, got %v", topic)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The queued PUBLISH should have been sent after reconnecting")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 3 || events[0] != "lost" || events[1] != "reconnecting" || events[2] != "reconnected" {
+		t.Errorf("The reconnect events were reported incorrectly: %v", events)
+	}
+}
+
+func TestClientCloseStopsReconnect(t *testing.T) {
+	address := (&testServer{Accept: func(n int, conn *connection, connect *packet) *packet {
+		conn.send(newPacketConnectAck(ConnectAckProperties{}))
+		return nil
+	}}).start(t)
+	lost := make(chan struct{})
+	attempts := make(chan int, 10)
+	client := Client{Name: "client1", AutoReconnect: true, Backoff: Backoff{Initial: 50 * time.Millisecond}}
+	client.OnConnectionLost = func(err error) { close(lost) }
+	client.OnReconnecting = func(attempt int) { attempts <- attempt }
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	<-lost
+	client.Close()
+	if err := client.send(newPacketPublish(PublishProperties{TopicName: "a"}, nil)); err != ErrNotConnected {
+		t.Errorf("Publishing after Close should fail with ErrNotConnected, got %v", err)
+	}
+	select {
+	case attempt := <-attempts:
+		t.Errorf("The client should not reconnect after Close, got attempt %v", attempt)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestClientReconnectRefused(t *testing.T) {
+	address := (&testServer{Connections: 2, Accept: func(n int, conn *connection, connect *packet) *packet {
+		if n == 0 {
+			// Lose the first connection right after accepting it
+			conn.send(newPacketConnectAck(ConnectAckProperties{}))
+			return nil
+		}
+		return newPacketConnectAck(ConnectAckProperties{ReturnCode: 5})
+	}}).start(t)
+	errs := make(chan error, 10)
+	attempts := make(chan int, 10)
+	client := Client{Name: "client1", AutoReconnect: true, Backoff: Backoff{Initial: 10 * time.Millisecond}}
+	client.OnReconnecting = func(attempt int) { attempts <- attempt }
+	client.OnReconnectError = func(attempt int, err error) { errs <- err }
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	select {
+	case err := <-errs:
+		if err != ErrNotAuthorized {
+			t.Errorf("The refusal should have been reported, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The failed attempt should have been reported")
+	}
+	<-attempts
+	select {
+	case attempt := <-attempts:
+		t.Errorf("The client should have stopped reconnecting after the refusal, got attempt %v", attempt)
+	case <-time.After(150 * time.Millisecond):
+	}
+	if err := client.send(newPacketPublish(PublishProperties{TopicName: "a"}, nil)); err != ErrNotConnected {
+		t.Errorf("Publishing after giving up should fail with ErrNotConnected, got %v", err)
+	}
+}
+
+func TestClientReconnectReleasesPacketIDs(t *testing.T) {
+	subscribes := 0
+	server := &testServer{Connections: 2, Answer: func(conn *connection, p *packet) {
+		if h, ok := p.properties.(SubscribeProperties); ok {
+			// Lose the first connection before the SUBACK
+			if subscribes++; subscribes == 1 {
+				conn.close()
+				return
+			}
+			conn.send(newPacketSubscribeAck(SubscribeAckProperties{PacketID: h.PacketID},
+				SubscribeAckPayload{ReturnCodes: []SubscribeReturnCode{SubscribeGrantedAtMostOnce}}))
+		}
+	}}
+	address := server.start(t)
+	reconnected := make(chan struct{})
+	client := Client{Name: "client1", AutoReconnect: true, Backoff: Backoff{Initial: 10 * time.Millisecond}}
+	client.OnReconnect = func() { close(reconnected) }
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.SubscribeTo(Topic{Name: "a/b", Message: ""}, SubscriberOptions{}); err != nil {
+		t.Fatalf("The client should have subscribed: %v", err)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The client should have reconnected")
+	}
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		client.lock.Lock()
+		used := len(client.packetIDs.used)
+		client.lock.Unlock()
+		if used == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The packet identifiers of the SUBSCRIBE packets should have been released, %v are in use", used)
+		}
+	}
+}
+
+func TestClientReconnectCleanSessionInterruptsDeliveries(t *testing.T) {
+	address := (&testServer{Connections: 2, Answer: func(conn *connection, p *packet) {
+		// Lose the connection before the PUBACK
+		if p.ptype == ptypePublish {
+			conn.close()
+		}
+	}}).start(t)
+	client := Client{Name: "client1", AutoReconnect: true, Backoff: Backoff{Initial: 10 * time.Millisecond}}
+	pub := connectDeliveries(t, &client, address, ProtocolLevel311, QoSAtLeastOnce)
+	defer client.Close()
+	token := pub.SendAsync("hello")
+	select {
+	case <-token.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("The delivery should have completed once the client reconnected with a clean session")
+	}
+	if err := token.Err(); err != ErrDeliveryInterrupted {
+		t.Errorf("The delivery should have been interrupted, got %v", err)
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if len(client.deliveries) != 0 || len(client.packetIDs.used) != 0 {
+		t.Errorf("The discarded delivery should have been forgotten, got %v deliveries and %v packet identifiers",
+			len(client.deliveries), len(client.packetIDs.used))
+	}
+}
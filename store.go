@@ -0,0 +1,194 @@
+package wavemq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SessionStore saves the sessions of a client so that they can be resumed with Client.Reconnect after the process has
+// restarted. A session is saved together with its state: the subscriptions, the outbound QoS 1 and QoS 2 packets that
+// are in flight and the identifiers of the inbound QoS 2 packets that were received but not released yet.
+//
+// Load returns ErrUnknownSession if the store does not have a session with the id.
+type SessionStore interface {
+	Save(id string, session Session) error
+	Load(id string) (Session, error)
+	Delete(id string) error
+}
+
+// storedSession is the form a session takes in a store. Unlike Session, all of its fields are exported so that it can
+// be encoded with the 'encoding/gob' package.
+type storedSession struct {
+	Name                 string
+	ServerAddress        string
+	Identifier           string
+	ConnectionProperties ConnectProperties
+	Subscriptions        []TopicSubscription
+	InFlight             []inFlightPacket
+	Received             []uint16
+}
+
+// newStoredSession copies the session and its state. The copy does not share memory with the session.
+func newStoredSession(session Session) storedSession {
+	stored := storedSession{
+		Name:                 session.Name,
+		ServerAddress:        session.ServerAddress,
+		Identifier:           session.identifier,
+		ConnectionProperties: session.ConnectionProperties,
+	}
+	if s := session.state; s != nil {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		stored.Subscriptions = append([]TopicSubscription(nil), s.Subscriptions...)
+		stored.InFlight = append([]inFlightPacket(nil), s.InFlight...)
+		stored.Received = append([]uint16(nil), s.Received...)
+	}
+	return stored
+}
+
+// session turns the stored session back into a session with its own state.
+func (s storedSession) session() Session {
+	return Session{
+		Name:                 s.Name,
+		ServerAddress:        s.ServerAddress,
+		identifier:           s.Identifier,
+		ConnectionProperties: s.ConnectionProperties,
+		state: &sessionState{
+			Subscriptions: append([]TopicSubscription(nil), s.Subscriptions...),
+			InFlight:      append([]inFlightPacket(nil), s.InFlight...),
+			Received:      append([]uint16(nil), s.Received...),
+		},
+	}
+}
+
+// MemorySessionStore keeps sessions in memory. It does not survive a restart of the process, but lets a session be
+// resumed by another Client in the same process. The zero value is ready to use.
+type MemorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]storedSession
+}
+
+// Save implements the SessionStore interface.
+func (m *MemorySessionStore) Save(id string, session Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.sessions == nil {
+		m.sessions = map[string]storedSession{}
+	}
+	m.sessions[id] = newStoredSession(session)
+	return nil
+}
+
+// Load implements the SessionStore interface.
+func (m *MemorySessionStore) Load(id string) (Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stored, ok := m.sessions[id]
+	if !ok {
+		return Session{}, ErrUnknownSession
+	}
+	return stored.session(), nil
+}
+
+// Delete implements the SessionStore interface.
+func (m *MemorySessionStore) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// FileSessionStore saves every session to its own file in a directory, encoded with the 'encoding/gob' package. A file
+// is replaced atomically when the session is saved again, so a crash never leaves a session half written.
+type FileSessionStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// NewFileSessionStore creates a store that saves sessions in the directory, creating the directory if it does not
+// exist yet.
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+// Save implements the SessionStore interface.
+func (f *FileSessionStore) Save(id string, session Session) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	if err = gob.NewEncoder(&buf).Encode(newStoredSession(session)); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	tmp, err := os.CreateTemp(f.dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(buf.Bytes()); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load implements the SessionStore interface.
+func (f *FileSessionStore) Load(id string) (Session, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return Session{}, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Session{}, ErrUnknownSession
+	} else if err != nil {
+		return Session{}, err
+	}
+	defer file.Close()
+	stored := storedSession{}
+	if err = gob.NewDecoder(file).Decode(&stored); err != nil {
+		return Session{}, err
+	}
+	return stored.session(), nil
+}
+
+// Delete implements the SessionStore interface.
+func (f *FileSessionStore) Delete(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path returns the file a session is saved in. The id must not be able to name a file outside of the directory.
+func (f *FileSessionStore) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", errors.New("Invalid session id")
+	}
+	return filepath.Join(f.dir, id+".session"), nil
+}
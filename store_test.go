@@ -0,0 +1,57 @@
+package wavemq
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testSession() Session {
+	return Session{
+		Name:                 "client1",
+		ServerAddress:        "mqtts://broker:8883",
+		identifier:           "client1",
+		ConnectionProperties: ConnectProperties{ProtocolName: "MQTT", ProtocolLevel: 4, KeepAlive: 30},
+		state: &sessionState{
+			Subscriptions: []TopicSubscription{{Filter: "a/#", QoS: QoSAtLeastOnce}},
+			InFlight:      []inFlightPacket{{PacketID: 3, Packet: []byte{0x62, 0x02, 0x00, 0x03}}},
+			Received:      []uint16{9},
+		},
+	}
+}
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	session := testSession()
+	if err := store.Save("abc", session); err != nil {
+		t.Fatalf("An error occurred while saving the session: %v", err)
+	}
+	session.state.release(3)
+	loaded, err := store.Load("abc")
+	if err != nil {
+		t.Fatalf("An error occurred while loading the session: %v", err)
+	}
+	expected := newStoredSession(testSession())
+	if !reflect.DeepEqual(newStoredSession(loaded), expected) {
+		t.Errorf("The session was loaded incorrectly. Expected %+v and got %+v", expected, newStoredSession(loaded))
+	}
+	if err = store.Delete("abc"); err != nil {
+		t.Errorf("An error occurred while deleting the session: %v", err)
+	}
+	if _, err = store.Load("abc"); err != ErrUnknownSession {
+		t.Errorf("A deleted session should be unknown, got %v", err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, &MemorySessionStore{})
+}
+
+func TestFileSessionStore(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("An error occurred while creating the store: %v", err)
+	}
+	testSessionStore(t, store)
+	if err = store.Save("../abc", testSession()); err == nil {
+		t.Errorf("A session id should not be able to name a file outside of the directory")
+	}
+}
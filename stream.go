@@ -0,0 +1,120 @@
+package wavemq
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// MaxRemainingLength is the largest remaining length that can be represented by the variable length encoding used in
+// the fixed header of a MQTT control packet.
+const MaxRemainingLength uint32 = 268435455
+
+// DefaultMaxPacketSize is the largest packet (fixed header included) a client accepts from the server. It allows every
+// packet that can be represented by the protocol.
+const DefaultMaxPacketSize uint32 = MaxRemainingLength + 5
+
+// ErrPacketTooLarge is returned when the remaining length of the next packet on a connection says it is larger than the
+// maximum packet size. The packet is not read, so the connection can no longer be used.
+var ErrPacketTooLarge = errors.New("Packet exceeds the maximum packet size")
+
+// packetReader reads MQTT control packets one at a time from an io.Reader such as a net.Conn. Each call to readPacket
+// reads exactly one framed packet: the fixed header, then as many bytes as the remaining length says follow it.
+//
+// Packets are decoded in the format of the protocol level of the connection, which is MQTT 3.1.1 until it is changed
+// with setProtocolLevel or a CONNECT packet is read, in which case the level requested by the CONNECT is adopted.
+//
+// A packetReader is not safe for concurrent use.
+type packetReader struct {
+	reader        *bufio.Reader
+	maxPacketSize uint32
+	level         byte
+}
+
+// newPacketReader creates a packetReader on top of the provided reader. Packets larger than maxPacketSize bytes are
+// rejected with ErrPacketTooLarge. If maxPacketSize is zero, DefaultMaxPacketSize is used.
+func newPacketReader(r io.Reader, maxPacketSize uint32) *packetReader {
+	if maxPacketSize == 0 {
+		maxPacketSize = DefaultMaxPacketSize
+	}
+	return &packetReader{reader: bufio.NewReader(r), maxPacketSize: maxPacketSize, level: ProtocolLevel311}
+}
+
+// setProtocolLevel changes the protocol level the packets that are read next are decoded with. A client calls this
+// with the level it sent in its CONNECT packet.
+func (pr *packetReader) setProtocolLevel(level byte) {
+	pr.level = level
+}
+
+// readPacket blocks until the next packet has been read from the underlying reader and returns it decoded. io.EOF is
+// returned if the stream ends cleanly between two packets, and io.ErrUnexpectedEOF if it ends part way through one.
+func (pr *packetReader) readPacket() (*packet, error) {
+	control, err := pr.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readRemainingLength(pr.reader)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{control}, encodeRemainingLength(length)...)
+	if uint64(len(header))+uint64(length) > uint64(pr.maxPacketSize) {
+		return nil, ErrPacketTooLarge
+	}
+	frame := make([]byte, len(header)+int(length))
+	copy(frame, header)
+	if _, err = io.ReadFull(pr.reader, frame[len(header):]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	p := &packet{level: pr.level}
+	if err = p.decode(frame); err != nil {
+		return nil, err
+	}
+	if p.ptype == ptypeConnect {
+		pr.level = p.level
+	}
+	return p, nil
+}
+
+// packetWriter encodes MQTT control packets and writes them to an io.Writer such as a net.Conn. Each packet is
+// written with a single call to Write so that packets are never interleaved on the underlying writer.
+//
+// Packets are encoded in the format of the protocol level of the connection, which is MQTT 3.1.1 until it is changed
+// with setProtocolLevel or a CONNECT packet is written, in which case the level requested by the CONNECT is adopted.
+//
+// A packetWriter is not safe for concurrent use.
+type packetWriter struct {
+	writer io.Writer
+	level  byte
+}
+
+// newPacketWriter creates a packetWriter on top of the provided writer.
+func newPacketWriter(w io.Writer) *packetWriter {
+	return &packetWriter{writer: w, level: ProtocolLevel311}
+}
+
+// setProtocolLevel changes the protocol level the packets that are written next are encoded with. A server calls this
+// with the level of the CONNECT packet it accepted.
+func (pw *packetWriter) setProtocolLevel(level byte) {
+	pw.level = level
+}
+
+// writePacket encodes the packet and writes it to the underlying writer.
+func (pw *packetWriter) writePacket(p *packet) error {
+	if h, ok := p.properties.(ConnectProperties); ok && p.ptype == ptypeConnect {
+		pw.level = byte(h.ProtocolLevel)
+	}
+	p.level = pw.level
+	if err := p.encode(); err != nil {
+		return err
+	}
+	_, err := pw.writer.Write(p.buffer.Bytes())
+	return err
+}
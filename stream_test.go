@@ -0,0 +1,62 @@
+package wavemq
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPacketReaderWriter(t *testing.T) {
+	stream := bytes.Buffer{}
+	writer := newPacketWriter(&stream)
+	sent := []*packet{
+		newPacketPublish(PublishProperties{QoSLevel: QoSAtLeastOnce, TopicName: "a/b", PacketID: 1}, []byte("hello")),
+		newPacketPingReq(),
+		newPacketPublishAck(PublishAckProperties{PacketID: 1}),
+		newPacketDisconnect(DisconnectProperties{}),
+	}
+	for _, p := range sent {
+		if err := writer.writePacket(p); err != nil {
+			t.Fatalf("An error occurred while writing the packet: %v", err)
+		}
+	}
+
+	reader := newPacketReader(&stream, 0)
+	for _, expected := range sent {
+		p, err := reader.readPacket()
+		if err != nil {
+			t.Fatalf("An error occurred while reading the packet: %v", err)
+		}
+		if p.ptype != expected.ptype || p.pflags != expected.pflags {
+			t.Errorf("The packet was read incorrectly. Expected type %x and got %x", expected.ptype, p.ptype)
+		}
+		if !bytes.Equal(p.payload, expected.payload) {
+			t.Errorf("The payload was read incorrectly. Expected %v and got %v", expected.payload, p.payload)
+		}
+	}
+	if _, err := reader.readPacket(); err != io.EOF {
+		t.Errorf("There should have been an EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestPacketReaderMaxPacketSize(t *testing.T) {
+	stream := bytes.Buffer{}
+	p := newPacketPublish(PublishProperties{TopicName: "a/b"}, make([]byte, 100))
+	if err := newPacketWriter(&stream).writePacket(p); err != nil {
+		t.Fatalf("An error occurred while writing the packet: %v", err)
+	}
+	if _, err := newPacketReader(&stream, 50).readPacket(); err != ErrPacketTooLarge {
+		t.Errorf("There should have been a packet too large error, got %v", err)
+	}
+}
+
+func TestPacketReaderTruncated(t *testing.T) {
+	stream := bytes.NewBuffer([]byte{0x40, 0x02, 0x00})
+	if _, err := newPacketReader(stream, 0).readPacket(); err != io.ErrUnexpectedEOF {
+		t.Errorf("There should have been an unexpected EOF error, got %v", err)
+	}
+	stream = bytes.NewBuffer([]byte{0x30, 0x80})
+	if _, err := newPacketReader(stream, 0).readPacket(); err != io.ErrUnexpectedEOF {
+		t.Errorf("There should have been an unexpected EOF error, got %v", err)
+	}
+}
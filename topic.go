@@ -1,10 +1,118 @@
 package wavemq
 
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"strings"
+)
+
 // Topic represents a publish/subscribe topic in the MQTT protocol. A topic essentially consists of name (string) and
 // a message to send (interface, since it could be anything). Topics also keep track of their encoder and decoder.
-// Topics are uniquely identifiable by the combination of the name and the message, so two topics that have the same
-// name but are handling separate messages would be two completely separate topics in WaveMQ.
+// Since the messages that arrive on a topic do not say which type they were published with, a client only subscribes
+// to a topic name with a single message type: subscribing to the same name with another message type fails with
+// ErrSubscriptionConflict.
+//
+// The quality of service of the topic is the maximum quality of service requested when subscribing to it.
 type Topic struct {
 	Name    string
 	Message interface{}
+	QoS     QoSLevel
+}
+
+// encode turns a message that is published on the topic into the bytes of a PUBLISH payload or will message. If the
+// message of the topic implements Encodeable, every message must implement it and encodes itself. Otherwise the
+// message is encoded with the 'encoding/gob' package, each on its own so that it can be decoded without the messages
+// that came before it.
+func (t Topic) encode(message interface{}) ([]byte, error) {
+	if t.encodeable() {
+		m, ok := message.(Encodeable)
+		if !ok {
+			return nil, errors.New("Unable to encode message because it does not implement 'Encodeable' like the topic")
+		}
+		return m.Encode()
+	}
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(message); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decode turns the payload of a PUBLISH packet received on the topic into the target, the reverse of encode. If the
+// message of the topic implements Encodeable, the target must implement Decodeable. Otherwise the payload is decoded
+// with the 'encoding/gob' package.
+func (t Topic) decode(payload []byte, target interface{}) error {
+	if err := t.checkTarget(target); err != nil {
+		return err
+	}
+	if m, ok := target.(Decodeable); ok && t.encodeable() {
+		return m.Decode(payload)
+	}
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(target)
+}
+
+// decodeNew decodes the payload of a PUBLISH packet received on the topic into a new value of the type of the message
+// of the topic and returns it.
+func (t Topic) decodeNew(payload []byte) (interface{}, error) {
+	typ := reflect.TypeOf(t.Message)
+	if typ == nil {
+		return nil, errors.New("Unable to decode message because the topic does not have a message type")
+	}
+	target := reflect.New(typ)
+	if err := t.decode(payload, target.Interface()); err != nil {
+		return nil, err
+	}
+	return target.Elem().Interface(), nil
+}
+
+// checkTarget verifies that messages of the topic can be decoded into the target, which must implement Decodeable if
+// the message of the topic implements Encodeable.
+func (t Topic) checkTarget(target interface{}) error {
+	if _, ok := target.(Decodeable); !ok && t.encodeable() {
+		return errors.New("Unable to decode message because the target does not implement 'Decodeable'")
+	}
+	return nil
+}
+
+// encodeable reports whether the messages of the topic implement Encodeable.
+func (t Topic) encodeable() bool {
+	_, ok := t.Message.(Encodeable)
+	return ok
+}
+
+// checkTopicName verifies that the name can be published to: it must have at least one character and must not contain
+// the wildcard characters that are reserved for topic filters.
+//
+// REQ: MQTT-4.7.3-1, MQTT-3.3.2-2
+func checkTopicName(name string) error {
+	if len(name) == 0 {
+		return errors.New("A topic name must be at least one character long")
+	}
+	if strings.ContainsAny(name, "#+") {
+		return errors.New("A topic name must not contain wildcard characters")
+	}
+	return nil
+}
+
+// matchTopic reports whether the topic name matches the topic filter. A "+" in the filter matches exactly one level of
+// the name and a "#" at the end of the filter matches the parent level and any number of levels below it. Names that
+// start with "$" are not matched by a filter that starts with a wildcard.
+//
+// REQ: MQTT-4.7.1-2, MQTT-4.7.1-3, MQTT-4.7.2-1
+func matchTopic(filter string, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filters, names := strings.Split(filter, "/"), strings.Split(name, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(names) || (f != "+" && f != names[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(names)
 }
@@ -0,0 +1,29 @@
+package wavemq
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter  string
+		name    string
+		matches bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"+/+", "/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, test := range tests {
+		if matches := matchTopic(test.filter, test.name); matches != test.matches {
+			t.Errorf("Matching %q against %q should have returned %v", test.name, test.filter, test.matches)
+		}
+	}
+}
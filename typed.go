@@ -0,0 +1,83 @@
+package wavemq
+
+import (
+	"context"
+)
+
+// TypedTopic is a topic whose messages are of type T. It is the same as a Topic whose message is a value of type T,
+// except that the type of the messages is checked by the compiler when they are published and received. T must be a
+// concrete, non-pointer type: either a type that implements Encodeable with a pointer that implements Decodeable, or
+// a type that can be encoded with the 'encoding/gob' package. Publishing or subscribing on a typed topic of an
+// interface type fails with ErrNoMessageType.
+type TypedTopic[T any] struct {
+	Name string
+	QoS  QoSLevel
+}
+
+// Topic returns the untyped topic that the typed topic stands for.
+func (t TypedTopic[T]) Topic() Topic {
+	var message T
+	return Topic{Name: t.Name, Message: message, QoS: t.QoS}
+}
+
+// TypedPublisher sends messages of type T on a typed topic. It is a Publisher whose Send and SendAsync only accept
+// messages of type T.
+type TypedPublisher[T any] struct {
+	*Publisher
+}
+
+// PublishTyped creates a publisher that sends messages of type T on the topic over the connection of the client, like
+// Client.PublishOn.
+func PublishTyped[T any](c *Client, topic TypedTopic[T]) (*TypedPublisher[T], error) {
+	pub, err := c.PublishOn(topic.Topic())
+	if err != nil {
+		return nil, err
+	}
+	return &TypedPublisher[T]{Publisher: pub}, nil
+}
+
+// Send publishes the message like Publisher.Send.
+func (pc *TypedPublisher[T]) Send(message T) error {
+	return pc.Publisher.Send(message)
+}
+
+// SendAsync publishes the message like Publisher.SendAsync.
+func (pc *TypedPublisher[T]) SendAsync(message T) *PublishToken {
+	return pc.Publisher.SendAsync(message)
+}
+
+// TypedSubscriber receives messages of type T on a typed topic. It is a Subscriber, so it is muted, unmuted and closed
+// like any other subscriber.
+type TypedSubscriber[T any] struct {
+	*Subscriber
+}
+
+// SubscribeTyped creates a synchronous subscriber on the topic, like Client.SubscribeTo.
+func SubscribeTyped[T any](c *Client, topic TypedTopic[T], options SubscriberOptions) (*TypedSubscriber[T], error) {
+	sub, err := c.SubscribeTo(topic.Topic(), options)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedSubscriber[T]{Subscriber: sub}, nil
+}
+
+// SubscribeTypedAsynch creates an asynchronous subscriber on the topic that invokes the handler with every message
+// that arrives, like Client.SubscribeToAsynch.
+func SubscribeTypedAsynch[T any](c *Client, topic TypedTopic[T], handler func(T), options SubscriberOptions) (
+	*TypedSubscriber[T], error) {
+	sub, err := c.SubscribeToAsynch(topic.Topic(), func(message interface{}) {
+		handler(message.(T))
+	}, options)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedSubscriber[T]{Subscriber: sub}, nil
+}
+
+// Receive blocks until the next message on the topic arrives, or the context is done, and returns it. It fails in the
+// same way as Subscriber.ReceiveInContext.
+func (sc *TypedSubscriber[T]) Receive(ctx context.Context) (T, error) {
+	var message T
+	err := sc.ReceiveInContext(ctx, &message)
+	return message, err
+}
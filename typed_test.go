@@ -0,0 +1,92 @@
+package wavemq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTypedSubscribers(t *testing.T) {
+	server := &testServer{Answer: func(conn *connection, p *packet) {}}
+	address := server.start(t)
+	publishes := server.Publishes
+	defer close(publishes)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	points, err := SubscribeTyped(&client, TypedTopic[point]{Name: "points"}, SubscriberOptions{})
+	if err != nil {
+		t.Fatalf("The client should have subscribed: %v", err)
+	}
+	texts := make(chan string, 1)
+	_, err = SubscribeTypedAsynch(&client, TypedTopic[string]{Name: "text"}, func(s string) { texts <- s },
+		SubscriberOptions{})
+	if err != nil {
+		t.Fatalf("The client should have subscribed: %v", err)
+	}
+
+	payload, _ := TypedTopic[point]{}.Topic().encode(point{3, 4})
+	publishes <- newPacketPublish(PublishProperties{TopicName: "points"}, payload)
+	payload, _ = TypedTopic[string]{}.Topic().encode("hello")
+	publishes <- newPacketPublish(PublishProperties{TopicName: "text"}, payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if p, err := points.Receive(ctx); err != nil || p != (point{3, 4}) {
+		t.Errorf("The point should have been received, got %v and error %v", p, err)
+	}
+	select {
+	case s := <-texts:
+		if s != "hello" {
+			t.Errorf("The handler should have been invoked with %q, got %q", "hello", s)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("The handler should have been invoked")
+	}
+}
+
+func TestTypedPublisher(t *testing.T) {
+	server := &testServer{}
+	address := server.start(t)
+	client := Client{Name: "client1"}
+	if _, err := client.Connect(address, ConnectProperties{CleanSession: true}); err != nil {
+		t.Fatalf("The client should have connected: %v", err)
+	}
+	defer client.Close()
+	server.next(t)
+
+	topic := TypedTopic[point]{Name: "points"}
+	pub, err := PublishTyped(&client, topic)
+	if err != nil {
+		t.Fatalf("The publisher should have been created: %v", err)
+	}
+	if err := pub.Send(point{1, 2}); err != nil {
+		t.Fatalf("The message should have been published: %v", err)
+	}
+	var p point
+	if err := topic.Topic().decode(server.next(t).payload, &p); err != nil || p != (point{1, 2}) {
+		t.Errorf("The server should have received the point, got %v and error %v", p, err)
+	}
+}
+
+func TestTopicWithoutMessageType(t *testing.T) {
+	client := Client{Name: "client1"}
+	topic := TypedTopic[any]{Name: "anything"}
+	if _, err := PublishTyped(&client, topic); err != ErrNoMessageType {
+		t.Errorf("Publishing on a topic of an interface type should have failed, got %v", err)
+	}
+	if _, err := SubscribeTyped(&client, topic, SubscriberOptions{}); err != ErrNoMessageType {
+		t.Errorf("Subscribing to a topic of an interface type should have failed, got %v", err)
+	}
+	if _, err := client.PublishOn(Topic{Name: "nothing"}); err != ErrNoMessageType {
+		t.Errorf("Publishing on a topic without a message should have failed, got %v", err)
+	}
+	if _, err := client.SubscribeTo(Topic{Name: "nothing"}, SubscriberOptions{}); err != ErrNoMessageType {
+		t.Errorf("Subscribing to a topic without a message should have failed, got %v", err)
+	}
+	if len(client.subscribers) != 0 || len(client.publishers) != 0 {
+		t.Errorf("The client should not have kept the publishers or subscribers")
+	}
+}
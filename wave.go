@@ -1,10 +1,199 @@
 package wavemq
 
-// Session ...
+import (
+	"sync"
+)
+
+// Session is a connection of a client to a server that can be resumed, and is known on the server by its client
+// identifier. Name is the name of the client that created the session, ServerAddress the address it connected to and
+// ConnectionProperties the properties of the CONNECT packet that started it. The state of the session holds what the
+// client needs to resume it after reconnecting: the topics it subscribed to and the QoS 1 and QoS 2 packets that are
+// in flight.
 type Session struct {
 	Name                 string
 	ServerAddress        string
 	identifier           string
 	ConnectionProperties ConnectProperties
-	state                interface{}
+	state                *sessionState
+}
+
+// Identifier returns the client identifier the session is known by on the server.
+func (s Session) Identifier() string {
+	return s.identifier
+}
+
+// sessionState is the part of a session that changes while the client is connected. In flight packets are the PUBLISH
+// packets with QoS 1 or QoS 2 and the PUBREL packets that have not been acknowledged yet. They are kept encoded, in the
+// order they were first sent, so that they can be sent again in that order when the session is resumed. Received holds
+// the packet identifiers of the inbound QoS 2 PUBLISH packets that have not been released by a PUBREL yet.
+//
+// REQ: MQTT-4.4.0-1, MQTT-4.6.0-1
+type sessionState struct {
+	lock          sync.Mutex
+	Subscriptions []TopicSubscription
+	InFlight      []inFlightPacket
+	Received      []uint16
+}
+
+// inFlightPacket is an encoded packet that waits for its acknowledgement.
+type inFlightPacket struct {
+	PacketID uint16
+	Packet   []byte
+}
+
+// subscribed records that the session subscribed to the topics. A topic filter that was already subscribed to is
+// replaced, like the server does.
+func (s *sessionState) subscribed(topics []TopicSubscription) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, topic := range topics {
+		if i := indexOfFilter(s.Subscriptions, topic.Filter); i >= 0 {
+			s.Subscriptions[i] = topic
+		} else {
+			s.Subscriptions = append(s.Subscriptions, topic)
+		}
+	}
+}
+
+// unsubscribed records that the session unsubscribed from the topic filter.
+func (s *sessionState) unsubscribed(filter string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i := indexOfFilter(s.Subscriptions, filter); i >= 0 {
+		s.Subscriptions = append(s.Subscriptions[:i], s.Subscriptions[i+1:]...)
+	}
+}
+
+// subscriptions returns a copy of the topics the session subscribed to.
+func (s *sessionState) subscriptions() []TopicSubscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]TopicSubscription(nil), s.Subscriptions...)
+}
+
+// store records the packet as in flight under its packet identifier. A packet that is already in flight with the same
+// identifier is replaced in place, which is how a PUBREL takes over from the QoS 2 PUBLISH it releases.
+func (s *sessionState) store(packetID uint16, p *packet) error {
+	if err := p.encode(); err != nil {
+		return err
+	}
+	encoded := append([]byte(nil), p.buffer.Bytes()...)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.InFlight {
+		if s.InFlight[i].PacketID == packetID {
+			s.InFlight[i].Packet = encoded
+			return nil
+		}
+	}
+	s.InFlight = append(s.InFlight, inFlightPacket{PacketID: packetID, Packet: encoded})
+	return nil
+}
+
+// release removes the packet with the identifier from the in flight packets once it has been acknowledged.
+func (s *sessionState) release(packetID uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.InFlight {
+		if s.InFlight[i].PacketID == packetID {
+			s.InFlight = append(s.InFlight[:i], s.InFlight[i+1:]...)
+			return
+		}
+	}
+}
+
+// inFlightIDs returns the packet identifiers of the packets that are in flight.
+func (s *sessionState) inFlightIDs() []uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]uint16, 0, len(s.InFlight))
+	for _, f := range s.InFlight {
+		ids = append(ids, f.PacketID)
+	}
+	return ids
+}
+
+// received records that an inbound QoS 2 PUBLISH packet with the identifier arrived. It returns false if the packet
+// identifier was already waiting to be released, which means the PUBLISH is a duplicate.
+func (s *sessionState) received(packetID uint16) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, id := range s.Received {
+		if id == packetID {
+			return false
+		}
+	}
+	s.Received = append(s.Received, packetID)
+	return true
+}
+
+// released forgets the inbound QoS 2 packet identifier once the PUBREL for it arrived.
+func (s *sessionState) released(packetID uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, id := range s.Received {
+		if id == packetID {
+			s.Received = append(s.Received[:i], s.Received[i+1:]...)
+			return
+		}
+	}
+}
+
+// serverLost forgets the part of the session that only matters while the server has the session as well, which is
+// needed when the server started a new session instead of resuming it. The packet identifiers of the inbound QoS 2
+// packets are forgotten, since the server does not release them and may use them for new messages.
+func (s *sessionState) serverLost() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Received = nil
+}
+
+// pending reports whether the session has packets in flight or inbound QoS 2 packets that were not released yet, which
+// would be lost if the session was not resumed.
+func (s *sessionState) pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.InFlight) > 0 || len(s.Received) > 0
+}
+
+// clear forgets everything about the session, which is what happens when a clean session starts.
+func (s *sessionState) clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.InFlight = nil
+	s.Subscriptions = nil
+	s.Received = nil
+}
+
+// replay decodes the in flight packets in the order they were first sent, ready to be sent again. PUBLISH packets are
+// marked as duplicates.
+//
+// REQ: MQTT-3.3.1-1
+func (s *sessionState) replay(level byte) ([]*packet, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	packets := make([]*packet, 0, len(s.InFlight))
+	for _, f := range s.InFlight {
+		p := &packet{level: level}
+		if err := p.decode(f.Packet); err != nil {
+			return nil, err
+		}
+		if h, ok := p.properties.(PublishProperties); ok {
+			h.DupFlag = true
+			p.properties = h
+			p.pflags |= 0x08
+		}
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// indexOfFilter returns the index of the topic filter in the list of topics, or -1 if it is not there.
+func indexOfFilter(topics []TopicSubscription, filter string) int {
+	for i, topic := range topics {
+		if topic.Filter == filter {
+			return i
+		}
+	}
+	return -1
 }
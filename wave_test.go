@@ -0,0 +1,40 @@
+package wavemq
+
+import (
+	"testing"
+)
+
+func TestSessionStateInFlight(t *testing.T) {
+	s := sessionState{}
+	publish := func(id uint16) *packet {
+		return newPacketPublish(PublishProperties{QoSLevel: QoSExactlyOnce, TopicName: "a", PacketID: id}, []byte{0x01})
+	}
+	for _, id := range []uint16{1, 2, 3} {
+		if err := s.store(id, publish(id)); err != nil {
+			t.Fatalf("An error occurred while storing packet %v: %v", id, err)
+		}
+	}
+	s.store(2, newPacketPublishRel(PublishRelProperties{PacketID: 2}))
+	s.release(1)
+
+	packets, err := s.replay(ProtocolLevel311)
+	if err != nil {
+		t.Fatalf("An error occurred while replaying the in flight packets: %v", err)
+	}
+	if len(packets) != 2 || packets[0].ptype != ptypePubrel || packets[1].ptype != ptypePublish {
+		t.Fatalf("The PUBREL should have taken the place of its PUBLISH, got %v packets", len(packets))
+	}
+	if h := packets[1].properties.(PublishProperties); !h.DupFlag || h.PacketID != 3 || packets[1].pflags&0x08 == 0 {
+		t.Errorf("A replayed PUBLISH should be marked as a duplicate: %+v", h)
+	}
+}
+
+func TestSessionStateSubscriptions(t *testing.T) {
+	s := sessionState{}
+	s.subscribed([]TopicSubscription{{Filter: "a", QoS: QoSAtMostOnce}, {Filter: "b", QoS: QoSAtMostOnce}})
+	s.subscribed([]TopicSubscription{{Filter: "a", QoS: QoSExactlyOnce}})
+	topics := s.subscriptions()
+	if len(topics) != 2 || topics[0].QoS != QoSExactlyOnce || topics[1].Filter != "b" {
+		t.Errorf("Subscribing to a topic filter again should replace it, got %v", topics)
+	}
+}